@@ -0,0 +1,172 @@
+package wsworld
+
+// Actions are named inputs, e.g. "move_left", bound to any number of raw inputs.
+// An action is down if any of its inputs is down. Input strings are:
+//
+//      "ArrowLeft", "a", "space"       -- a logical key, as for KeyDown()
+//      "code:KeyA"                     -- a physical key code, as for CodeDown()
+//      "pad0:button14"                 -- a gamepad button, as for GamepadButton()
+//      "pad0:axis0-", "pad0:axis1+"    -- a gamepad axis pushed past halfway in that direction
+//
+// Mouse clicks can't be bound since they have no held state; use PollClicks() or PollEvents().
+
+import (
+    "strconv"
+    "strings"
+)
+
+const ACTION_AXIS_THRESHOLD = 0.5
+
+func BindAction(action string, inputs ...string) {
+
+    // Sets the default inputs for an action, replacing any previous ones.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    eng.actions[action] = append([]string(nil), inputs...)
+}
+
+func BindPlayerAction(pid int, action string, inputs ...string) {
+
+    // Sets the inputs for an action for one player only, overriding the default.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil {
+        return
+    }
+
+    if eng.players[pid].actions == nil {
+        eng.players[pid].actions = make(map[string][]string)
+    }
+
+    eng.players[pid].actions[action] = append([]string(nil), inputs...)
+}
+
+func ClearPlayerBindings(pid int) {
+
+    // Returns the player to the default bindings.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil {
+        return
+    }
+
+    eng.players[pid].actions = nil
+}
+
+func ActionDown(pid int, action string) bool {
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil {
+        return false
+    }
+
+    return eng.players[pid].action_down(action)
+}
+
+func ActionPressed(pid int, action string) bool {
+
+    // True if the action is down now but wasn't the last time this function was called
+    // for this action and player. Note that a press and release entirely between two
+    // calls is missed; use PollEvents() if that matters.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    p := eng.players[pid]
+
+    if p == nil {
+        return false
+    }
+
+    if p.action_prev == nil {
+        p.action_prev = make(map[string]bool)
+    }
+
+    down := p.action_down(action)
+    ret := down && p.action_prev[action] == false
+    p.action_prev[action] = down
+
+    return ret
+}
+
+func (p *player) action_down(action string) bool {     // Caller must hold the engine mutex
+
+    inputs, ok := p.actions[action]
+    if ok == false {
+        inputs = eng.actions[action]
+    }
+
+    for _, input := range inputs {
+        if p.input_down(input) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (p *player) input_down(input string) bool {        // Caller must hold the engine mutex
+
+    if strings.HasPrefix(input, "code:") {
+        _, ret := p.codes[input[5:]]
+        return ret
+    }
+
+    if strings.HasPrefix(input, "pad") && strings.Contains(input, ":") {
+
+        colon := strings.Index(input, ":")
+
+        pad, err := strconv.Atoi(input[3:colon])
+        if err != nil {
+            return p.keyboard[input]
+        }
+
+        rest := input[colon + 1:]
+
+        if p.gamepads[pad] == nil {
+            return false
+        }
+
+        if strings.HasPrefix(rest, "button") {
+            button, _ := strconv.Atoi(rest[6:])
+            return p.gamepads[pad].buttons[button]
+        }
+
+        if strings.HasPrefix(rest, "axis") && len(rest) > 5 {
+            axis, _ := strconv.Atoi(rest[4:len(rest) - 1])
+            value := p.gamepads[pad].axes[axis]
+            if strings.HasSuffix(rest, "-") {
+                return value <= -ACTION_AXIS_THRESHOLD
+            }
+            return value >= ACTION_AXIS_THRESHOLD
+        }
+
+        return false
+    }
+
+    return p.keyboard[input]
+}
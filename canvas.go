@@ -2,6 +2,8 @@ package wsworld
 
 import (
     "fmt"
+    "math"
+    "strconv"
     "strings"
     "sync"
 
@@ -9,9 +11,30 @@ import (
 )
 
 
+const FLOATING_TEXT_RISE = 40.0    // Pixels per second
+
 type Canvas struct {
     mutex           sync.Mutex
     entities        []string
+    hidden_layers   map[int]bool        // Survives Clear()
+    camera          *camera             // Survives Clear(), nil if not in use
+    tilemaps        []*Tilemap          // Added this frame, so their grids can be sent first
+    interp_delay    int                 // Survives Clear(), 0 for extrapolation
+    groups          []group             // Sub-canvases, expanded by Bytes()
+}
+
+type group struct {
+    index           int                 // Of the group's header in the parent's entities
+    canvas          *Canvas
+}
+
+type camera struct {
+    x               float64
+    y               float64
+    zoom            float64
+    angle           float64
+    speedx          float64
+    speedy          float64
 }
 func NewCanvas() *Canvas {
     ret := new(Canvas)
@@ -22,6 +45,8 @@ func (w *Canvas) Clear() {
     w.mutex.Lock()
     defer w.mutex.Unlock()
     w.entities = []string{"v"}
+    w.tilemaps = nil
+    w.groups = nil
 }
 func (w *Canvas) Bytes() []byte {
 
@@ -38,9 +63,62 @@ func (w *Canvas) Bytes() []byte {
         w.entities = append([]string{"v"}, w.entities...)
     }
 
+    // Things that survive Clear() are sent at the start of every frame...
+
+    var header []string
+
+    for layer, hidden := range w.hidden_layers {
+        if hidden {
+            header = append(header, fmt.Sprintf("h\x1f%d", layer))
+        }
+    }
+
+    if w.camera != nil {
+        c := w.camera
+        header = append(header, fmt.Sprintf("k\x1f%.1f\x1f%.1f\x1f%.3f\x1f%.3f\x1f%.1f\x1f%.1f", c.x, c.y, c.zoom, c.angle, c.speedx * eng.fps, c.speedy * eng.fps))
+    }
+
+    if w.interp_delay > 0 {
+        header = append(header, fmt.Sprintf("i\x1f%d", w.interp_delay))
+    }
+
+    if len(header) > 0 || len(w.groups) > 0 {
+        all := append([]string{"v"}, header...)
+        all = append(all, w.body()...)
+        return []byte(strings.Join(all, "\x1e"))
+    }
+
     return []byte(strings.Join(w.entities, "\x1e"))
 }
 
+func (w *Canvas) body() []string {        // Caller holds the mutex
+
+    // Everything after the "v", with each group's contents following its header...
+
+    if len(w.groups) == 0 {
+        return w.entities[1:]
+    }
+
+    var ret []string
+    g := 0
+
+    for i := 1; i < len(w.entities); i++ {
+        ret = append(ret, w.entities[i])
+        for g < len(w.groups) && w.groups[g].index == i {
+            child := w.groups[g].canvas
+            child.mutex.Lock()
+            if len(child.entities) > 0 {
+                ret = append(ret, child.body()...)
+            }
+            child.mutex.Unlock()
+            ret = append(ret, "U")
+            g++
+        }
+    }
+
+    return ret
+}
+
 type Soundscape struct {
     mutex           sync.Mutex
     soundqueue      []string
@@ -74,10 +152,299 @@ func (z *Soundscape) Bytes() []byte {
 }
 
 
-func (w *Canvas) AddPoint(colour string, x, y, speedx, speedy float64) {
+// Layers. Everything added after SetLayer() is in that layer, until the next SetLayer() or the
+// end of the frame. The client draws lower layers first; within a layer, things are drawn in
+// the order they were added. Since the layer is part of the canvas's state, goroutines sharing
+// a canvas should not rely on it.
+
+const (
+    LAYER_BACKGROUND = -100
+    LAYER_WORLD = 0             // The default
+    LAYER_HUD = 100
+)
+
+func (w *Canvas) SetLayer(layer int) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("z\x1f%d", layer))
+}
+
+func (w *Canvas) SetLayerVisible(layer int, visible bool) {       // Unlike SetLayer(), this survives Clear()
     w.mutex.Lock()
     defer w.mutex.Unlock()
-    w.entities = append(w.entities, fmt.Sprintf("p\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f", colour, x, y, speedx * eng.fps, speedy * eng.fps))
+    if w.hidden_layers == nil {
+        w.hidden_layers = make(map[int]bool)
+    }
+    if visible {
+        delete(w.hidden_layers, layer)
+    } else {
+        w.hidden_layers[layer] = true
+    }
+}
+
+// Line style, for AddLine() and all the Outline / polyline / arc shapes. Like the layer, it
+// applies to everything added afterwards until changed, or until the end of the frame.
+
+type LineStyle struct {
+    Width           float64     // 0 means 1
+    Dash            []float64   // Alternating lengths of dash and gap, nil for a solid line
+    Cap             string      // "butt" (default), "round" or "square"
+    Join            string      // "miter" (default), "round" or "bevel"
+}
+
+func (w *Canvas) SetLineStyle(style LineStyle) {
+
+    width := style.Width
+    if width <= 0 {
+        width = 1
+    }
+
+    var dash []string
+    for _, d := range style.Dash {
+        dash = append(dash, fmt.Sprintf("%.1f", d))
+    }
+
+    linecap := style.Cap
+    if linecap != "round" && linecap != "square" {
+        linecap = "butt"
+    }
+
+    linejoin := style.Join
+    if linejoin != "round" && linejoin != "bevel" {
+        linejoin = "miter"
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("w\x1f%.1f\x1f%s\x1f%s\x1f%s", width, strings.Join(dash, ","), linecap, linejoin))
+}
+
+// Fills. A gradient or pattern can be used anywhere a colour can, by passing its Colour().
+// Coordinates are relative to the position of the thing being drawn: the centre of circles,
+// arcs, points, sprites and text, the top left of rects, and the first point of lines and
+// polygons. For AddPoints(), they are absolute.
+
+type GradientStop struct {
+    Offset          float64     // 0 to 1
+    Colour          Colour
+}
+
+type LinearGradient struct {
+    X0, Y0          float64
+    X1, Y1          float64
+    Stops           []GradientStop
+}
+
+type RadialGradient struct {
+    X0, Y0, R0      float64     // The inner circle
+    X1, Y1, R1      float64     // The outer circle. Negative radii make the fill invalid
+    Stops           []GradientStop
+}
+
+type Pattern struct {
+    Filename        string      // A registered sprite
+    Repeat          string      // "repeat" (default), "repeat-x", "repeat-y" or "no-repeat"
+}
+
+func (g LinearGradient) String() string {
+    return fmt.Sprintf("~l|%.1f|%.1f|%.1f|%.1f", g.X0, g.Y0, g.X1, g.Y1) + stops_string(g.Stops)
+}
+
+func (g RadialGradient) String() string {
+    return fmt.Sprintf("~r|%.1f|%.1f|%.1f|%.1f|%.1f|%.1f", g.X0, g.Y0, g.R0, g.X1, g.Y1, g.R1) + stops_string(g.Stops)
+}
+
+func (p Pattern) String() string {
+    repeat := p.Repeat
+    if repeat != "repeat-x" && repeat != "repeat-y" && repeat != "no-repeat" {
+        repeat = "repeat"
+    }
+    return fmt.Sprintf("~p|%s|%s", eng.sprites[p.Filename], repeat)
+}
+
+func (g LinearGradient) Colour() Colour {
+    return g.String()
+}
+
+func (g RadialGradient) Colour() Colour {
+    return g.String()
+}
+
+func (p Pattern) Colour() Colour {
+    return p.String()
+}
+
+func stops_string(stops []GradientStop) string {
+    var parts []string
+    for _, stop := range stops {
+        colour := strings.Replace(colour_wire(stop.Colour), "|", "", -1)
+        parts = append(parts, fmt.Sprintf("|%.3f|%s", stop.Offset, colour))
+    }
+    return strings.Join(parts, "")
+}
+
+// Shadow, for everything added afterwards until changed, or until the end of the frame.
+// SetShadow("", 0, 0, 0) turns it off.
+
+func (w *Canvas) SetShadow(colour Colour, blur, offsetx, offsety float64) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("x\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f", colour_wire_or_none(colour), blur, offsetx, offsety))
+}
+
+// Motion, for everything added afterwards until changed, or until the end of the frame. Between
+// frames the client moves things by their speeds; with this it also accelerates them by ax, ay
+// (change in speed per frame, so gravity is a positive ay) and turns them by spin (change in
+// angle per frame) about their centre. Batched points and tilemaps don't spin. SetMotion(0, 0, 0)
+// turns it off.
+
+func (w *Canvas) SetMotion(ax, ay, spin float64) {
+    fps2 := eng.fps * eng.fps
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("q\x1f%.1f\x1f%.1f\x1f%.4f", ax * fps2, ay * fps2, spin * eng.fps))
+}
+
+// Groups. A group is a canvas whose contents are positioned relative to the group, which is
+// itself translated, rotated and scaled as a whole -- e.g. a tank's hull and turret can be drawn
+// around (0, 0) and moved together. The group is drawn where Group() was called, so it's in the
+// layer current at that point, and layers, styles etc. set inside it don't leak out. Groups can
+// be nested. Only the top-level canvas should be sent; camera, interpolation and hidden layers
+// set on a group are ignored. Clear() on the parent discards its groups. In interpolation mode,
+// SetNextID() just before Group() gives the group an id, so it's blended like things are.
+
+func (w *Canvas) Group(x, y, angle, scale, speedx, speedy float64) *Canvas {
+
+    if scale == 0 {
+        scale = 1
+    }
+
+    child := NewCanvas()
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("G\x1f%.1f\x1f%.1f\x1f%.3f\x1f%.3f\x1f%.1f\x1f%.1f", x, y, angle, scale, speedx * eng.fps, speedy * eng.fps))
+    w.groups = append(w.groups, group{index: len(w.entities) - 1, canvas: child})
+    return child
+}
+
+// Interpolation. By default the client draws things where they'd be now, extrapolating from
+// the latest frame with their speeds, which overshoots when things turn. Instead, the client
+// can draw delay_ms in the past, blending between the frames either side of that moment. Things
+// are matched across frames by id, set with SetNextID(); things without ids are extrapolated
+// as usual. The delay should be at least one or two frames' worth. 0 turns it off.
+
+func (w *Canvas) SetInterpolation(delay_ms int) {       // Survives Clear()
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.interp_delay = delay_ms
+}
+
+func (w *Canvas) SetNextID(id int) {                    // Gives the next thing added an id (tilemaps are skipped)
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("n\x1f%d", id))
+}
+
+// Camera. With a camera set, things in layers below LAYER_HUD are in world coordinates, and
+// the client shows them as seen by the camera: x, y is the world point at the centre of the
+// screen, zoom > 1 magnifies, and angle (radians) rotates the view. Layers at or above
+// LAYER_HUD stay in screen coordinates. For a camera per player, use a canvas per player
+// and SendToPlayer().
+
+func (w *Canvas) SetCamera(x, y, zoom, angle, speedx, speedy float64) {       // Survives Clear()
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    if zoom <= 0 {
+        zoom = 1
+    }
+    w.camera = &camera{x, y, zoom, angle, speedx, speedy}
+}
+
+func (w *Canvas) RemoveCamera() {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.camera = nil
+}
+
+func (w *Canvas) ScreenToWorld(x, y float64) (float64, float64) {
+
+    // Converts screen coordinates, e.g. from a click, to world coordinates, using the camera
+    // as it was last set (ignoring any client-side motion since).
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if w.camera == nil {
+        return x, y
+    }
+
+    c := w.camera
+
+    dx := (x - float64(eng.width) / 2) / c.zoom        // eng.width and eng.height are written once only
+    dy := (y - float64(eng.height) / 2) / c.zoom
+
+    sin, cos := math.Sin(c.angle), math.Cos(c.angle)
+
+    return c.x + dx * cos - dy * sin, c.y + dx * sin + dy * cos
+}
+
+func (w *Canvas) AddPoint(colour Colour, x, y, speedx, speedy float64) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, point_blob(colour, x, y, speedx, speedy))
+}
+
+func point_blob(colour Colour, x, y, speedx, speedy float64) string {
+    return fmt.Sprintf("p\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f", colour_wire(colour), x, y, speedx * eng.fps, speedy * eng.fps)
+}
+
+func (w *Canvas) AddPoints(colour Colour, points []float64) {
+
+    // Many points of one colour in a single compact blob. The slice holds x, y, speedx, speedy
+    // for each point in turn.
+
+    buf := make([]byte, 0, len(points) * 6)
+
+    for n := 0 ; n + 3 < len(points) ; n += 4 {
+        if n > 0 {
+            buf = append(buf, ',')
+        }
+        buf = strconv.AppendFloat(buf, points[n], 'f', 1, 64)
+        buf = append(buf, ',')
+        buf = strconv.AppendFloat(buf, points[n + 1], 'f', 1, 64)
+        buf = append(buf, ',')
+        buf = strconv.AppendFloat(buf, points[n + 2] * eng.fps, 'f', 1, 64)
+        buf = append(buf, ',')
+        buf = strconv.AppendFloat(buf, points[n + 3] * eng.fps, 'f', 1, 64)
+    }
+
+    if len(buf) == 0 {
+        return
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, "P\x1f" + colour_wire(colour) + "\x1f" + string(buf))
+}
+
+func (w *Canvas) SetPointStyle(size float64, round bool) {
+
+    // Applies to points added afterwards, until changed or until the end of the frame.
+    // The default is size 1, square.
+
+    if size <= 0 {
+        size = 1
+    }
+
+    shape := "square"
+    if round {
+        shape = "round"
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("o\x1f%.1f\x1f%s", size, shape))
 }
 
 func (w *Canvas) AddSprite(filename string, x, y, speedx, speedy float64) {
@@ -87,18 +454,240 @@ func (w *Canvas) AddSprite(filename string, x, y, speedx, speedy float64) {
     w.entities = append(w.entities, fmt.Sprintf("s\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f", varname, x, y, speedx * eng.fps, speedy * eng.fps))
 }
 
-func (w *Canvas) AddLine(colour string, x1, y1, x2, y2, speedx, speedy float64) {
+func (w *Canvas) AddFrame(filename string, frame int, x, y, speedx, speedy float64) {
+    w.AddAnimation(filename, frame, frame, 0, x, y, speedx, speedy)
+}
+
+func (w *Canvas) AddAnimation(filename string, first, last int, rate, x, y, speedx, speedy float64) {
+
+    // Draws frames first to last of a sprite sheet, looping, at rate frames per second.
+    // The client advances the frames by itself, even when no new frames arrive.
+
+    if last < first {
+        last = first
+    }
+
+    varname := eng.sprites[filename]        // Safe to read without mutex since there are no writes any more
+    if varname == "" {
+        return
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("f\x1f%s\x1f%d\x1f%d\x1f%.2f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f", varname, first, last, rate, x, y, speedx * eng.fps, speedy * eng.fps))
+}
+
+type SpriteOptions struct {
+    Angle           float64     // Radians, clockwise
+    Spin            float64     // Change in angle per frame, like speedx and speedy
+    ScaleX          float64     // 0 means 1
+    ScaleY          float64     // 0 means 1
+    FlipX           bool        // Mirror horizontally
+    FlipY           bool        // Mirror vertically
+    Fade            float64     // 0 is opaque, 1 is invisible
+}
+
+func (w *Canvas) AddSpriteEx(filename string, x, y, speedx, speedy float64, opts SpriteOptions) {
+    if eng.sprites[filename] == "" {        // Safe to read without mutex since there are no writes any more
+        return
+    }
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, sprite_ex_blob(filename, x, y, speedx, speedy, opts))
+}
+
+func sprite_ex_blob(filename string, x, y, speedx, speedy float64, opts SpriteOptions) string {
+
+    scalex, scaley := opts.ScaleX, opts.ScaleY
+
+    if scalex == 0 {
+        scalex = 1
+    }
+    if scaley == 0 {
+        scaley = 1
+    }
+    if opts.FlipX {
+        scalex = -scalex
+    }
+    if opts.FlipY {
+        scaley = -scaley
+    }
+
+    alpha := 1 - opts.Fade
+
+    varname := eng.sprites[filename]        // Safe to read without mutex since there are no writes any more
+    return fmt.Sprintf("S\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.3f\x1f%.3f\x1f%.3f\x1f%.3f\x1f%.2f",
+        varname, x, y, speedx * eng.fps, speedy * eng.fps, opts.Angle, opts.Spin * eng.fps, scalex, scaley, alpha)
+}
+
+func (w *Canvas) AddLine(colour Colour, x1, y1, x2, y2, speedx, speedy float64) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("l\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f", colour_wire(colour), x1, y1, x2, y2, speedx * eng.fps, speedy * eng.fps))
+}
+
+func (w *Canvas) AddText(text string, colour Colour, size int, font string, x, y, speedx, speedy float64) {
     w.mutex.Lock()
     defer w.mutex.Unlock()
-    w.entities = append(w.entities, fmt.Sprintf("l\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f", colour, x1, y1, x2, y2, speedx * eng.fps, speedy * eng.fps))
+    w.entities = append(w.entities, text_blob(text, colour, size, font, x, y, speedx, speedy))
 }
 
-func (w *Canvas) AddText(text, colour string, size int, font string, x, y, speedx, speedy float64) {
+func text_blob(text string, colour Colour, size int, font string, x, y, speedx, speedy float64) string {
+    text = strings.Replace(text, "\x1e", " ", -1)       // Replace meaningful characters in our protocol
+    text = strings.Replace(text, "\x1f", " ", -1)
+    return fmt.Sprintf("t\x1f%s\x1f%d\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%s", colour_wire(colour), size, font, x, y, speedx * eng.fps, speedy * eng.fps, text)
+}
+
+func (w *Canvas) AddFloatingText(text string, colour Colour, size int, font string, x, y float64, duration_ms int) {
+
+    // Text that rises and fades out over the duration, e.g. damage numbers. It only needs to be
+    // added once; the client keeps drawing it through later frames.
+
     w.mutex.Lock()
     defer w.mutex.Unlock()
     text = strings.Replace(text, "\x1e", " ", -1)       // Replace meaningful characters in our protocol
     text = strings.Replace(text, "\x1f", " ", -1)
-    w.entities = append(w.entities, fmt.Sprintf("t\x1f%s\x1f%d\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%s", colour, size, font, x, y, speedx, speedy, text))
+    w.entities = append(w.entities, fmt.Sprintf("F\x1f%d\x1f%s\x1f%d\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%s", duration_ms, colour_wire(colour), size, font, x, y, 0.0, -FLOATING_TEXT_RISE, text))
+}
+
+func (w *Canvas) SetFadeOut(duration_ms int) {
+
+    // Things added after this, until SetFadeOut(0) or the end of the frame, are kept by the
+    // client after later frames arrive, fading out over the duration while moving at their
+    // given speed. So they should only be added once.
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("e\x1f%d", duration_ms))
+}
+
+// Text style, for AddText(). Like the layer, it applies to everything added afterwards until
+// changed, or until the end of the frame. Text may contain newlines.
+
+type TextStyle struct {
+    Align           string      // "center" (default), "left" or "right"
+    Baseline        string      // "top", "middle", "bottom" or "alphabetic"; "" means the old behaviour
+    OutlineColour   Colour      // "" for no outline
+    OutlineWidth    float64
+    MaxWidth        float64     // Wrap lines longer than this; 0 for no wrapping
+    LineHeight      float64     // As a multiple of the size; 0 means 1.2
+}
+
+func (w *Canvas) SetTextStyle(style TextStyle) {
+
+    align := style.Align
+    if align != "left" && align != "right" {
+        align = "center"
+    }
+
+    baseline := style.Baseline
+    if baseline != "top" && baseline != "middle" && baseline != "bottom" && baseline != "alphabetic" {
+        baseline = ""
+    }
+
+    line_height := style.LineHeight
+    if line_height <= 0 {
+        line_height = 1.2
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("T\x1f%s\x1f%s\x1f%s\x1f%.1f\x1f%.1f\x1f%.2f", align, baseline, colour_wire_or_none(style.OutlineColour), style.OutlineWidth, style.MaxWidth, line_height))
+}
+
+// For the shapes below, Add<Shape>() fills and Add<Shape>Outline() strokes. Angles are in radians,
+// clockwise from the positive x axis, as in the browser's canvas.
+
+func (w *Canvas) AddCircle(colour Colour, x, y, radius, speedx, speedy float64) {
+    w.add_circle(colour, true, x, y, radius, speedx, speedy)
+}
+
+func (w *Canvas) AddCircleOutline(colour Colour, x, y, radius, speedx, speedy float64) {
+    w.add_circle(colour, false, x, y, radius, speedx, speedy)
+}
+
+func (w *Canvas) add_circle(colour Colour, fill bool, x, y, radius, speedx, speedy float64) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, circle_blob(colour, fill, x, y, radius, speedx, speedy))
+}
+
+func circle_blob(colour Colour, fill bool, x, y, radius, speedx, speedy float64) string {
+    return fmt.Sprintf("c\x1f%s\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f", colour_wire(colour), fill_flag(fill), x, y, radius, speedx * eng.fps, speedy * eng.fps)
+}
+
+func (w *Canvas) AddRect(colour Colour, x, y, width, height, speedx, speedy float64) {
+    w.add_rect(colour, true, x, y, width, height, 0, speedx, speedy)
+}
+
+func (w *Canvas) AddRectOutline(colour Colour, x, y, width, height, speedx, speedy float64) {
+    w.add_rect(colour, false, x, y, width, height, 0, speedx, speedy)
+}
+
+func (w *Canvas) AddRoundRect(colour Colour, x, y, width, height, radius, speedx, speedy float64) {
+    w.add_rect(colour, true, x, y, width, height, radius, speedx, speedy)
+}
+
+func (w *Canvas) AddRoundRectOutline(colour Colour, x, y, width, height, radius, speedx, speedy float64) {
+    w.add_rect(colour, false, x, y, width, height, radius, speedx, speedy)
+}
+
+func (w *Canvas) add_rect(colour Colour, fill bool, x, y, width, height, radius, speedx, speedy float64) {      // x, y is the top left corner
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("r\x1f%s\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.1f", colour_wire(colour), fill_flag(fill), x, y, width, height, radius, speedx * eng.fps, speedy * eng.fps))
+}
+
+func (w *Canvas) AddArc(colour Colour, x, y, radius, start_angle, end_angle, speedx, speedy float64) {
+    w.add_arc(colour, false, x, y, radius, start_angle, end_angle, speedx, speedy)
+}
+
+func (w *Canvas) AddPie(colour Colour, x, y, radius, start_angle, end_angle, speedx, speedy float64) {     // A filled arc, closed at the centre
+    w.add_arc(colour, true, x, y, radius, start_angle, end_angle, speedx, speedy)
+}
+
+func (w *Canvas) add_arc(colour Colour, fill bool, x, y, radius, start_angle, end_angle, speedx, speedy float64) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, fmt.Sprintf("a\x1f%s\x1f%s\x1f%.1f\x1f%.1f\x1f%.1f\x1f%.3f\x1f%.3f\x1f%.1f\x1f%.1f", colour_wire(colour), fill_flag(fill), x, y, radius, start_angle, end_angle, speedx * eng.fps, speedy * eng.fps))
+}
+
+// Polygons and polylines take their points as x1, y1, x2, y2, ...
+
+func (w *Canvas) AddPolygon(colour Colour, points []float64, speedx, speedy float64) {
+    w.add_poly(colour, "f", points, speedx, speedy)
+}
+
+func (w *Canvas) AddPolygonOutline(colour Colour, points []float64, speedx, speedy float64) {
+    w.add_poly(colour, "c", points, speedx, speedy)
+}
+
+func (w *Canvas) AddPolyline(colour Colour, points []float64, speedx, speedy float64) {      // Not closed
+    w.add_poly(colour, "o", points, speedx, speedy)
+}
+
+func (w *Canvas) add_poly(colour Colour, mode string, points []float64, speedx, speedy float64) {
+
+    if len(points) < 4 {
+        return
+    }
+
+    parts := []string{"g", colour_wire(colour), mode, fmt.Sprintf("%.1f", speedx * eng.fps), fmt.Sprintf("%.1f", speedy * eng.fps)}
+
+    for n := 0 ; n + 1 < len(points) ; n += 2 {
+        parts = append(parts, fmt.Sprintf("%.1f", points[n]), fmt.Sprintf("%.1f", points[n + 1]))
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, strings.Join(parts, "\x1f"))
+}
+
+func fill_flag(fill bool) string {
+    if fill {
+        return "f"
+    }
+    return "o"
 }
 
 func (z *Soundscape) PlaySound(filename string) {
@@ -120,13 +709,55 @@ func (z *Soundscape) PlaySound(filename string) {
 func (w *Canvas) SendToAll() {
 
     visual_message := w.Bytes()
+    tilemaps := w.get_tilemaps()
 
     eng.mutex.Lock()
     defer eng.mutex.Unlock()
 
     for _, player := range eng.players {
+        for _, t := range tilemaps {
+            t.sync_to(player)
+        }
         player.conn.WriteMessage(websocket.TextMessage, visual_message)
     }
+
+    for _, t := range tilemaps {
+        t.forget_departed()
+    }
+}
+
+func (w *Canvas) SendToPlayer(pid int) {
+
+    visual_message := w.Bytes()
+    tilemaps := w.get_tilemaps()
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] != nil {
+        for _, t := range tilemaps {
+            t.sync_to(eng.players[pid])
+        }
+        eng.players[pid].conn.WriteMessage(websocket.TextMessage, visual_message)
+    }
+
+    for _, t := range tilemaps {
+        t.forget_departed()
+    }
+}
+
+func (w *Canvas) get_tilemaps() []*Tilemap {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    ret := append([]*Tilemap(nil), w.tilemaps...)
+    for _, g := range w.groups {
+        ret = append(ret, g.canvas.get_tilemaps()...)
+    }
+    return ret
 }
 
 func (z *Soundscape) SendToAll() {
@@ -0,0 +1,341 @@
+package wsworld
+
+// Colours are CSS colour strings. Colour is just another name for string, so any string can be
+// used where a Colour is wanted and vice versa. Colours are checked when they're added to a
+// canvas; a bad one is drawn as COLOUR_INVALID, with a warning printed once. What's sent is
+// compacted where possible, e.g. "#FF0000" and "rgb(255, 0, 0)" both go as "#f00".
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+type Colour = string
+
+const (
+    BLACK           Colour = "#000000"
+    WHITE           Colour = "#ffffff"
+    GREY            Colour = "#808080"
+    RED             Colour = "#ff0000"
+    GREEN           Colour = "#00ff00"
+    BLUE            Colour = "#0000ff"
+    YELLOW          Colour = "#ffff00"
+    CYAN            Colour = "#00ffff"
+    MAGENTA         Colour = "#ff00ff"
+    ORANGE          Colour = "#ffa500"
+    TRANSPARENT     Colour = "#0000"
+
+    COLOUR_INVALID  Colour = MAGENTA
+)
+
+func RGB(r, g, b int) Colour {
+    return Colour(fmt.Sprintf("#%02x%02x%02x", clamp_byte(r), clamp_byte(g), clamp_byte(b)))
+}
+
+func RGBA(r, g, b int, a float64) Colour {              // a is from 0 to 1
+    return Colour(fmt.Sprintf("#%02x%02x%02x%02x", clamp_byte(r), clamp_byte(g), clamp_byte(b), clamp_byte(int(math.Round(a * 255)))))
+}
+
+func HSL(h, s, l float64) Colour {
+
+    // h in degrees, s and l from 0 to 1. Converted here, so what's sent is plain hex.
+
+    h = math.Mod(h, 360)
+    if h < 0 {
+        h += 360
+    }
+    s = math.Max(0, math.Min(1, s))
+    l = math.Max(0, math.Min(1, l))
+
+    c := (1 - math.Abs(2 * l - 1)) * s
+    x := c * (1 - math.Abs(math.Mod(h / 60, 2) - 1))
+    m := l - c / 2
+
+    var r, g, b float64
+
+    switch {
+    case h < 60:
+        r, g, b = c, x, 0
+    case h < 120:
+        r, g, b = x, c, 0
+    case h < 180:
+        r, g, b = 0, c, x
+    case h < 240:
+        r, g, b = 0, x, c
+    case h < 300:
+        r, g, b = x, 0, c
+    default:
+        r, g, b = c, 0, x
+    }
+
+    return RGB(int(math.Round((r + m) * 255)), int(math.Round((g + m) * 255)), int(math.Round((b + m) * 255)))
+}
+
+func Hex(s string) Colour {                             // The # is optional
+    if strings.HasPrefix(s, "#") == false {
+        s = "#" + s
+    }
+    return Colour(strings.ToLower(s))
+}
+
+func ParseColour(s string) (Colour, error) {
+    c := Colour(strings.TrimSpace(s))
+    if ValidColour(c) == false {
+        return COLOUR_INVALID, fmt.Errorf("ParseColour(): not a colour: %q", s)
+    }
+    return c, nil
+}
+
+func ValidColour(c Colour) bool {
+
+    s := strings.ToLower(c)
+
+    if strings.ContainsAny(s, "\x1e\x1f") {
+        return false
+    }
+
+    if strings.HasPrefix(s, "~") {                      // Gradients and patterns
+        return valid_fill(s)
+    }
+
+    if strings.HasPrefix(s, "#") {
+        if len(s) != 4 && len(s) != 5 && len(s) != 7 && len(s) != 9 {
+            return false
+        }
+        for _, ch := range s[1:] {
+            if strings.ContainsRune("0123456789abcdef", ch) == false {
+                return false
+            }
+        }
+        return true
+    }
+
+    for _, prefix := range []string{"rgb(", "rgba(", "hsl(", "hsla("} {
+        if strings.HasPrefix(s, prefix) && strings.HasSuffix(s, ")") {
+            for _, ch := range s[len(prefix) : len(s) - 1] {
+                if strings.ContainsRune("0123456789.,%+- /deg", ch) == false {
+                    return false
+                }
+            }
+            return true
+        }
+    }
+
+    return css_colour_names[s]
+}
+
+func valid_fill(s string) bool {
+
+    // ~l|x0|y0|x1|y1|stops...   ~r|x0|y0|r0|x1|y1|r1|stops...   ~p|varname|repeat
+    // where stops are offset|colour pairs. The client's gradient functions throw on anything
+    // else, which would stop it drawing at all.
+
+    parts := strings.Split(s, "|")
+
+    if parts[0] == "~p" {
+        if len(parts) != 3 || parts[1] == "" {
+            return false
+        }
+        switch parts[2] {
+        case "repeat", "repeat-x", "repeat-y", "no-repeat":
+            return true
+        }
+        return false
+    }
+
+    var count int
+
+    switch parts[0] {
+    case "~l":
+        count = 4
+    case "~r":
+        count = 6
+    default:
+        return false
+    }
+
+    if len(parts) < count + 1 || (len(parts) - count - 1) % 2 != 0 {
+        return false
+    }
+
+    for n := 1; n <= count; n++ {
+        f, err := strconv.ParseFloat(parts[n], 64)
+        if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+            return false
+        }
+        if parts[0] == "~r" && (n == 3 || n == 6) && f < 0 {     // Radii
+            return false
+        }
+    }
+
+    for n := count + 1; n + 1 < len(parts); n += 2 {
+        offset, err := strconv.ParseFloat(parts[n], 64)
+        if err != nil || offset < 0 || offset > 1 {
+            return false
+        }
+        if strings.HasPrefix(parts[n + 1], "~") || ValidColour(parts[n + 1]) == false {
+            return false
+        }
+    }
+
+    return true
+}
+
+var bad_colours_seen = make(map[Colour]bool)
+var bad_colours_mutex sync.Mutex
+
+func colour_wire(c Colour) string {
+
+    // What actually gets sent. Called at the API boundary, i.e. by every Canvas method.
+
+    if ValidColour(c) {
+        return compact_colour(c)
+    }
+
+    bad_colours_mutex.Lock()
+    if bad_colours_seen[c] == false {
+        bad_colours_seen[c] = true
+        fmt.Printf("wsworld: invalid colour %q\n", c)
+    }
+    bad_colours_mutex.Unlock()
+
+    return compact_colour(COLOUR_INVALID)
+}
+
+func colour_wire_or_none(c Colour) string {         // For optional colours, where "" means none
+    if c == "" {
+        return ""
+    }
+    return colour_wire(c)
+}
+
+func compact_colour(c Colour) string {
+
+    // c is valid. Hex and plain rgb() / rgba() become the shortest hex; names are left alone.
+
+    s := strings.ToLower(strings.TrimSpace(c))
+
+    if strings.HasPrefix(s, "~") {
+        return c                                    // Pattern varnames are case sensitive
+    }
+
+    if strings.HasPrefix(s, "rgb") {
+        if hex, ok := rgb_to_hex(s); ok {
+            s = hex
+        }
+    }
+
+    if strings.HasPrefix(s, "#") == false {
+        return s
+    }
+
+    digits := s[1:]
+
+    if len(digits) == 3 || len(digits) == 4 {
+        var long []byte
+        for n := 0; n < len(digits); n++ {
+            long = append(long, digits[n], digits[n])
+        }
+        digits = string(long)
+    }
+
+    if len(digits) == 8 && digits[6:] == "ff" {
+        digits = digits[:6]
+    }
+
+    short := true
+    for n := 0; n < len(digits); n += 2 {
+        if digits[n] != digits[n + 1] {
+            short = false
+        }
+    }
+
+    if short {
+        var b []byte
+        for n := 0; n < len(digits); n += 2 {
+            b = append(b, digits[n])
+        }
+        digits = string(b)
+    }
+
+    return "#" + digits
+}
+
+func rgb_to_hex(s string) (string, bool) {
+
+    // Only the plain form, rgb(r, g, b) or rgba(r, g, b, a) with integer r, g, b and a from 0 to 1.
+
+    open := strings.Index(s, "(")
+    args := strings.Split(s[open + 1 : len(s) - 1], ",")
+
+    if len(args) != 3 && len(args) != 4 {
+        return "", false
+    }
+
+    var b []int
+
+    for _, arg := range args[:3] {
+        n, err := strconv.Atoi(strings.TrimSpace(arg))
+        if err != nil || n < 0 || n > 255 {
+            return "", false
+        }
+        b = append(b, n)
+    }
+
+    if len(args) == 3 {
+        return fmt.Sprintf("#%02x%02x%02x", b[0], b[1], b[2]), true
+    }
+
+    a, err := strconv.ParseFloat(strings.TrimSpace(args[3]), 64)
+    if err != nil || a < 0 || a > 1 {
+        return "", false
+    }
+
+    return fmt.Sprintf("#%02x%02x%02x%02x", b[0], b[1], b[2], int(math.Round(a * 255))), true
+}
+
+func clamp_byte(n int) int {
+    if n < 0 {
+        return 0
+    }
+    if n > 255 {
+        return 255
+    }
+    return n
+}
+
+var css_colour_names = map[string]bool{
+    "transparent": true, "currentcolor": true,
+    "aliceblue": true, "antiquewhite": true, "aqua": true, "aquamarine": true, "azure": true, "beige": true,
+    "bisque": true, "black": true, "blanchedalmond": true, "blue": true, "blueviolet": true, "brown": true,
+    "burlywood": true, "cadetblue": true, "chartreuse": true, "chocolate": true, "coral": true,
+    "cornflowerblue": true, "cornsilk": true, "crimson": true, "cyan": true, "darkblue": true, "darkcyan": true,
+    "darkgoldenrod": true, "darkgray": true, "darkgreen": true, "darkgrey": true, "darkkhaki": true,
+    "darkmagenta": true, "darkolivegreen": true, "darkorange": true, "darkorchid": true, "darkred": true,
+    "darksalmon": true, "darkseagreen": true, "darkslateblue": true, "darkslategray": true,
+    "darkslategrey": true, "darkturquoise": true, "darkviolet": true, "deeppink": true, "deepskyblue": true,
+    "dimgray": true, "dimgrey": true, "dodgerblue": true, "firebrick": true, "floralwhite": true,
+    "forestgreen": true, "fuchsia": true, "gainsboro": true, "ghostwhite": true, "gold": true,
+    "goldenrod": true, "gray": true, "green": true, "greenyellow": true, "grey": true, "honeydew": true,
+    "hotpink": true, "indianred": true, "indigo": true, "ivory": true, "khaki": true, "lavender": true,
+    "lavenderblush": true, "lawngreen": true, "lemonchiffon": true, "lightblue": true, "lightcoral": true,
+    "lightcyan": true, "lightgoldenrodyellow": true, "lightgray": true, "lightgreen": true, "lightgrey": true,
+    "lightpink": true, "lightsalmon": true, "lightseagreen": true, "lightskyblue": true,
+    "lightslategray": true, "lightslategrey": true, "lightsteelblue": true, "lightyellow": true, "lime": true,
+    "limegreen": true, "linen": true, "magenta": true, "maroon": true, "mediumaquamarine": true,
+    "mediumblue": true, "mediumorchid": true, "mediumpurple": true, "mediumseagreen": true,
+    "mediumslateblue": true, "mediumspringgreen": true, "mediumturquoise": true, "mediumvioletred": true,
+    "midnightblue": true, "mintcream": true, "mistyrose": true, "moccasin": true, "navajowhite": true,
+    "navy": true, "oldlace": true, "olive": true, "olivedrab": true, "orange": true, "orangered": true,
+    "orchid": true, "palegoldenrod": true, "palegreen": true, "paleturquoise": true, "palevioletred": true,
+    "papayawhip": true, "peachpuff": true, "peru": true, "pink": true, "plum": true, "powderblue": true,
+    "purple": true, "rebeccapurple": true, "red": true, "rosybrown": true, "royalblue": true,
+    "saddlebrown": true, "salmon": true, "sandybrown": true, "seagreen": true, "seashell": true,
+    "sienna": true, "silver": true, "skyblue": true, "slateblue": true, "slategray": true, "slategrey": true,
+    "snow": true, "springgreen": true, "steelblue": true, "tan": true, "teal": true, "thistle": true,
+    "tomato": true, "turquoise": true, "violet": true, "wheat": true, "white": true, "whitesmoke": true,
+    "yellow": true, "yellowgreen": true,
+}
@@ -0,0 +1,134 @@
+package wsworld
+
+import (
+    "testing"
+)
+
+func TestValidColour(t *testing.T) {
+
+    tests := []struct {
+        colour          Colour
+        want            bool
+    }{
+        {"#f00", true},
+        {"#F00", true},
+        {"#f00a", true},
+        {"#ff0000", true},
+        {"#ff000080", true},
+        {"#ff00", true},
+        {"#ff000", false},
+        {"#ff00000", false},
+        {"#gg0000", false},
+        {"#", false},
+        {"red", true},
+        {"Red", true},
+        {"rebeccapurple", true},
+        {"transparent", true},
+        {"reed", false},
+        {"", false},
+        {"rgb(255, 0, 0)", true},
+        {"rgba(255, 0, 0, 0.5)", true},
+        {"hsl(120, 50%, 50%)", true},
+        {"rgb(255, 0, 0", false},
+        {"rgb(red)", false},
+        {"red\x1e", false},
+        {"#f00\x1f", false},
+        {"rgb(1,\x1f2,3)", false},
+
+        {"~l|0.0|0.0|10.0|10.0", true},
+        {"~l|0.0|0.0|10.0|10.0|0.000|#f00|1.000|blue", true},
+        {"~l|0|0|10|10|0.5", false},                               // Odd number of stop fields
+        {"~l|0|0|10", false},                                      // Too few numbers
+        {"~l|0|0|10|NaN", false},
+        {"~l|0|0|10|+Inf", false},
+        {"~l|0|0|10|10|1.5|#f00", false},                          // Offset out of range
+        {"~l|0|0|10|10|0.5|notacolour", false},
+        {"~l|0|0|10|10|0.5|~l|0|0|1|1", false},                    // Nested fill
+        {"~r|0|0|1|0|0|5|0|#f00|1|#00f", true},
+        {"~r|0|0|0|0|0|0", true},
+        {"~r|0|0|-1|0|0|5", false},                                // Negative radius
+        {"~r|0|0|1|0|0|-5", false},
+        {"~r|0|0|1|0|0", false},
+        {"~p|sprite0|repeat", true},
+        {"~p|sprite0|no-repeat", true},
+        {"~p|sprite0|sideways", false},
+        {"~p||repeat", false},
+        {"~p|sprite0", false},
+        {"~red", false},
+        {"~", false},
+    }
+
+    for _, test := range tests {
+        if got := ValidColour(test.colour); got != test.want {
+            t.Errorf("ValidColour(%q) = %v, want %v", test.colour, got, test.want)
+        }
+    }
+}
+
+func TestCompactColour(t *testing.T) {
+
+    tests := []struct {
+        colour          Colour
+        want            string
+    }{
+        {"#ff0000", "#f00"},
+        {"#FF0000", "#f00"},
+        {"#f00", "#f00"},
+        {"#123456", "#123456"},
+        {"#112233ff", "#123"},                  // Opaque alpha dropped
+        {"#11223344", "#1234"},
+        {"#12345678", "#12345678"},
+        {"#fffa", "#fffa"},
+        {"#ffff", "#fff"},
+        {"#0000", "#0000"},
+        {"rgb(255, 0, 0)", "#f00"},
+        {"rgb(18,52,86)", "#123456"},
+        {"rgba(0, 0, 0, 0.5)", "#00000080"},
+        {"rgba(0, 0, 0, 1)", "#000"},
+        {"rgb(100%, 0%, 0%)", "rgb(100%, 0%, 0%)"},   // Only plain integers are converted
+        {"rgb(255 0 0)", "rgb(255 0 0)"},
+        {"hsl(120, 50%, 50%)", "hsl(120, 50%, 50%)"},
+        {"Red", "red"},
+        {"~p|Sprite0|repeat", "~p|Sprite0|repeat"},   // Left alone
+    }
+
+    for _, test := range tests {
+        if got := compact_colour(test.colour); got != test.want {
+            t.Errorf("compact_colour(%q) = %q, want %q", test.colour, got, test.want)
+        }
+    }
+}
+
+func TestColourWireInvalid(t *testing.T) {
+    if got := colour_wire("~red"); got != compact_colour(COLOUR_INVALID) {
+        t.Errorf("colour_wire(\"~red\") = %q, want COLOUR_INVALID", got)
+    }
+    if got := colour_wire_or_none(""); got != "" {
+        t.Errorf("colour_wire_or_none(\"\") = %q, want \"\"", got)
+    }
+}
+
+func TestConstructors(t *testing.T) {
+
+    tests := []struct {
+        got             Colour
+        want            Colour
+    }{
+        {RGB(255, 0, 0), "#ff0000"},
+        {RGB(300, -5, 16), "#ff0010"},
+        {RGBA(0, 0, 0, 0.5), "#00000080"},
+        {HSL(0, 1, 0.5), "#ff0000"},
+        {HSL(480, 1, 0.5), "#00ff00"},
+        {Hex("ABCDEF"), "#abcdef"},
+        {RadialGradient{R0: 1, R1: 5, Stops: []GradientStop{{0, RED}, {1, "rgb(0, 0, 255)"}}}.Colour(), "~r|0.0|0.0|1.0|0.0|0.0|5.0|0.000|#f00|1.000|#00f"},
+    }
+
+    for _, test := range tests {
+        if test.got != test.want {
+            t.Errorf("got %q, want %q", test.got, test.want)
+        }
+        if ValidColour(test.got) == false {
+            t.Errorf("%q is not valid", test.got)
+        }
+    }
+}
@@ -7,19 +7,24 @@ import (
     "path/filepath"
     "strings"
     "sync"
+    "time"
+    "unicode/utf8"
 
     "github.com/gorilla/websocket"
 )
 
 const VIRTUAL_RESOURCE_DIR = "/wsworld_resources/"   // Path that the client thinks resources are at.
 const VIRTUAL_WS_DIR = "/wsworld_websocket/"         // Path that the client thinks websockets connect to.
+const MAX_QUEUED_EVENTS = 1024                       // Per player. Oldest events are dropped beyond this.
 
 var eng engine
 
 func init() {
     eng.sprites = make(map[string]string)
+    eng.sheets = make(map[string]sheet)
     eng.sounds = make(map[string]string)
     eng.players = make(map[int]*player)
+    eng.actions = make(map[string][]string)
 }
 
 type engine struct {
@@ -30,6 +35,8 @@ type engine struct {
 
     started         bool
     fps             float64
+    width           int
+    height          int
     res_path_local  string
     title           string
     static          string
@@ -38,12 +45,25 @@ type engine struct {
     // The following are written several times at the beginning, then only read from...
 
     sprites         map[string]string       // filename -> JS varname
+    sheets          map[string]sheet        // filename -> frame size, for sprites that are sprite sheets
     sounds          map[string]string       // filename -> JS varname
 
     // Written often...
 
     players         map[int]*player
     latest_player   int
+
+    // Settings that can be changed at any time...
+
+    drop_key_repeats bool
+    pointer_lock    bool
+    page            page_settings
+    actions         map[string][]string     // action -> default inputs
+}
+
+type sheet struct {
+    frame_w         int
+    frame_h         int
 }
 
 type click struct {
@@ -52,10 +72,61 @@ type click struct {
     Button          int
 }
 
+type event struct {
+    Type            string          // One of the EVENT_ constants below
+    Key             string          // keydown, keyup -- the logical key, e.g. "A" when Shift is held
+    Code            string          // keydown, keyup -- the physical key, e.g. "KeyA", regardless of layout
+    Shift           bool            // keydown, keyup
+    Ctrl            bool            // keydown, keyup
+    Alt             bool            // keydown, keyup
+    Meta            bool            // keydown, keyup
+    Repeat          bool            // keydown -- true if generated by the key being held down
+    X               int             // click
+    Y               int             // click
+    Button          int             // click (mouse button), padbutton
+    Pad             int             // padbutton, padaxis, padgone
+    Axis            int             // padaxis
+    Value           float64         // padbutton (0 or 1), padaxis
+    Focused         bool            // focus
+    Text            string          // text -- the string the player submitted
+    Locked          bool            // pointerlock
+    ClientTime      int64           // Milliseconds since the epoch, by the browser's clock
+    ServerTime      time.Time       // When the message arrived
+}
+
+// Event types. The values are the names the client uses for them.
+
+const (
+    EVENT_KEYDOWN = "keydown"
+    EVENT_KEYUP = "keyup"
+    EVENT_CLICK = "click"
+    EVENT_PADBUTTON = "padbutton"
+    EVENT_PADAXIS = "padaxis"
+    EVENT_PADGONE = "padgone"
+    EVENT_FOCUS_CHANGED = "focus"       // Losing focus also releases all keys
+    EVENT_TEXT = "text"
+    EVENT_TEXTCANCEL = "textcancel"
+    EVENT_POINTERLOCK = "pointerlock"
+)
+
+type gamepad struct {
+    buttons         map[int]bool
+    axes            map[int]float64
+}
+
 type player struct {
     pid             int
     keyboard        map[string]bool
+    codes           map[string]string       // Physical codes currently held -> logical key they produced
+    held            map[string]string       // The same, but never cleared by CodeDownClear() / KeyDownClear()
     clicks          []click
+    events          []event
+    gamepads        map[int]*gamepad       // Browser gamepad index -> state
+    actions         map[string][]string     // Per-player overrides of eng.actions, may be nil
+    action_prev     map[string]bool         // For ActionPressed(), may be nil
+    text_maxlen     int                     // From the latest RequestText()
+    mouse_dx        float64                 // Relative motion while pointer locked, since last PollMouseDelta()
+    mouse_dy        float64
     conn            *websocket.Conn
 }
 
@@ -71,6 +142,26 @@ func RegisterSprite(filename string) {
     eng.sprites[filename] = fmt.Sprintf("sprite%d", len(eng.sprites))
 }
 
+func RegisterSpriteSheet(filename string, frame_w, frame_h int) {
+
+    // A sprite sheet is a single image holding frames of equal size, numbered from 0,
+    // left to right then top to bottom. It can still be drawn whole with AddSprite().
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if eng.started {
+        panic("RegisterSpriteSheet(): already started")
+    }
+
+    if frame_w <= 0 || frame_h <= 0 {
+        panic("RegisterSpriteSheet(): bad frame size")
+    }
+
+    eng.sprites[filename] = fmt.Sprintf("sprite%d", len(eng.sprites))
+    eng.sheets[filename] = sheet{frame_w, frame_h}
+}
+
 func RegisterSound(filename string) {
 
     eng.mutex.Lock()
@@ -103,9 +194,11 @@ func Start(title, server, normal_path, res_path_local string, width, height int,
     eng.title = title
     eng.res_path_local = res_path_local
     eng.fps = fps
+    eng.width = width
+    eng.height = height
     eng.multiplayer = multiplayer
 
-    eng.static = static_webpage(eng.title, server, VIRTUAL_WS_DIR, VIRTUAL_RESOURCE_DIR, eng.sprites, eng.sounds, width, height)
+    eng.static = static_webpage(eng.title, server, VIRTUAL_WS_DIR, VIRTUAL_RESOURCE_DIR, eng.sprites, eng.sheets, eng.sounds, width, height)
 
     go http_startup(server, normal_path, VIRTUAL_WS_DIR, VIRTUAL_RESOURCE_DIR, res_path_local)
 }
@@ -139,6 +232,45 @@ func _keydown(pid int, key string, clear bool) bool {
     return ret
 }
 
+func CodeDown(pid int, code string) bool {
+    return _codedown(pid, code, false)
+}
+
+func CodeDownClear(pid int, code string) bool {     // Clears the code after
+    return _codedown(pid, code, true)
+}
+
+func _codedown(pid int, code string, clear bool) bool {
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil {
+        return false
+    }
+
+    _, ret := eng.players[pid].codes[code]
+
+    if clear {
+        delete(eng.players[pid].codes, code)
+    }
+
+    return ret
+}
+
+func DropKeyRepeats(b bool) {
+
+    // If set, keydown events caused by the browser's auto-repeat are ignored entirely.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    eng.drop_key_repeats = b
+}
+
 func PollClicks(pid int) []click {
 
     // Return a slice containing every click since the last time this function was called.
@@ -166,6 +298,156 @@ func PollClicks(pid int) []click {
     return ret
 }
 
+func PollEvents(pid int) []event {
+
+    // Return a slice containing every input event since the last time this function was called,
+    // in the order they arrived. Then clear the events from memory. Note that KeyDown() and
+    // PollClicks() are unaffected by this.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil {
+        return nil
+    }
+
+    ret := eng.players[pid].events
+    eng.players[pid].events = nil
+
+    return ret
+}
+
+func (p *player) add_event(e event) {                   // Caller must hold the engine mutex
+    if len(p.events) >= MAX_QUEUED_EVENTS {
+        p.events = p.events[1:]
+    }
+    p.events = append(p.events, e)
+}
+
+func (p *player) release_all_keys(ev event) {           // Caller must hold the engine mutex
+
+    // The browser never sends keyup for keys held while the page loses focus, so we
+    // synthesise them here, so that the event queue and KeyDown() agree. Every key that
+    // went down gets its keyup, even if the game has cleared it, since PollEvents() users
+    // saw the keydown regardless.
+
+    released := make(map[string]bool)
+
+    for code, key := range p.held {
+        up := ev
+        up.Type = EVENT_KEYUP
+        up.Key = key
+        up.Code = code
+        p.add_event(up)
+        released[key] = true
+    }
+
+    for key, down := range p.keyboard {
+        if down && released[key] == false {
+            up := ev
+            up.Type = EVENT_KEYUP
+            up.Key = key
+            p.add_event(up)
+        }
+    }
+
+    p.keyboard = make(map[string]bool)
+    p.codes = make(map[string]string)
+    p.held = make(map[string]string)
+}
+
+func GamepadButton(pid, pad, button int) bool {
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil || eng.players[pid].gamepads[pad] == nil {
+        return false
+    }
+
+    return eng.players[pid].gamepads[pad].buttons[button]
+}
+
+func GamepadAxis(pid, pad, axis int) float64 {
+
+    // Axes are in the range -1 to 1, as reported by the browser.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil || eng.players[pid].gamepads[pad] == nil {
+        return 0
+    }
+
+    return eng.players[pid].gamepads[pad].axes[axis]
+}
+
+func (p *player) get_gamepad(pad int) *gamepad {       // Caller must hold the engine mutex
+    if p.gamepads[pad] == nil {
+        p.gamepads[pad] = &gamepad{make(map[int]bool), make(map[int]float64)}
+    }
+    return p.gamepads[pad]
+}
+
+func SetPointerLock(b bool) {
+
+    // If set, clicking the canvas locks the pointer to it, hiding the cursor, and relative
+    // mouse motion becomes available from PollMouseDelta(). Players can always unlock with
+    // Escape; "pointerlock" events report the changes.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    eng.pointer_lock = b
+
+    msg := pointer_lock_message()
+
+    for _, player := range eng.players {
+        player.conn.WriteMessage(websocket.TextMessage, msg)
+    }
+}
+
+func pointer_lock_message() []byte {                    // Caller must hold the engine mutex
+    if eng.pointer_lock {
+        return []byte("m\x1e1")
+    }
+    return []byte("m\x1e0")
+}
+
+func PollMouseDelta(pid int) (float64, float64) {
+
+    // Return the total relative mouse motion since the last time this function was called.
+    // Then clear it.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil {
+        return 0, 0
+    }
+
+    dx, dy := eng.players[pid].mouse_dx, eng.players[pid].mouse_dy
+    eng.players[pid].mouse_dx, eng.players[pid].mouse_dy = 0, 0
+
+    return dx, dy
+}
+
 func PlayerCount() int {
 
     eng.mutex.Lock()
@@ -202,6 +484,43 @@ func SendDebugToAll(msg string) {
     eng.mutex.Unlock()
 }
 
+func RequestText(pid int, prompt string, maxlen int) {
+
+    // Opens a text box on the player's page. When they submit it, a "text" event arrives
+    // via PollEvents(), or "textcancel" if they press Escape. Keys typed into the box are
+    // not sent as keydown / keyup events.
+
+    prompt = strings.Replace(prompt, "\x1e", " ", -1)       // Replace meaningful characters in our protocol
+    prompt = strings.Replace(prompt, "\x1f", " ", -1)
+
+    if maxlen <= 0 {
+        maxlen = 256
+    }
+
+    b := []byte(fmt.Sprintf("i\x1e%s\x1e%d", prompt, maxlen))
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if pid == -1 {
+        pid = eng.latest_player
+    }
+
+    if eng.players[pid] == nil {
+        return
+    }
+
+    eng.players[pid].text_maxlen = maxlen
+    eng.players[pid].conn.WriteMessage(websocket.TextMessage, b)
+}
+
+func truncate_runes(s string, n int) string {
+    if utf8.RuneCountInString(s) <= n {
+        return s
+    }
+    return string([]rune(s)[:n])
+}
+
 func http_startup(server, normal_path, ws_path, res_path_server, res_path_local string) {
 
     // FIXME: how safe is the following, exactly?
@@ -0,0 +1,54 @@
+package wsworld
+
+import (
+    "sort"
+    "strings"
+    "testing"
+)
+
+func TestReleaseAllKeys(t *testing.T) {
+
+    // What the keydown handler would leave after Shift+A, then the game clearing things.
+
+    tests := []struct {
+        name            string
+        clear           func(p *player)
+        want            string          // Keyups made, as key/code, sorted
+    }{
+        {"nothing cleared", func(p *player) {}, "A/KeyA Shift/ShiftLeft"},
+        {"KeyDownClear", func(p *player) { p.keyboard["A"] = false }, "A/KeyA Shift/ShiftLeft"},
+        {"CodeDownClear", func(p *player) { delete(p.codes, "KeyA") }, "A/KeyA Shift/ShiftLeft"},
+        {"key with no code", func(p *player) { p.keyboard["x"] = true }, "A/KeyA Shift/ShiftLeft x/"},
+    }
+
+    for _, test := range tests {
+
+        p := &player{keyboard: make(map[string]bool), codes: make(map[string]string), held: make(map[string]string)}
+
+        for _, kc := range [][2]string{{"Shift", "ShiftLeft"}, {"A", "KeyA"}} {
+            p.keyboard[kc[0]] = true
+            p.codes[kc[1]] = kc[0]
+            p.held[kc[1]] = kc[0]
+        }
+
+        test.clear(p)
+        p.release_all_keys(event{Type: EVENT_FOCUS_CHANGED})
+
+        var got []string
+        for _, ev := range p.events {
+            if ev.Type != EVENT_KEYUP {
+                t.Errorf("%s: got a %q event", test.name, ev.Type)
+            }
+            got = append(got, ev.Key + "/" + ev.Code)
+        }
+        sort.Strings(got)
+
+        if strings.Join(got, " ") != test.want {
+            t.Errorf("%s: got keyups %q, want %q", test.name, strings.Join(got, " "), test.want)
+        }
+
+        if len(p.keyboard) != 0 || len(p.codes) != 0 || len(p.held) != 0 {
+            t.Errorf("%s: keys still down afterwards", test.name)
+        }
+    }
+}
@@ -0,0 +1,100 @@
+package wsworld
+
+// Page settings: how the page around the drawing looks. These can be set before or after
+// Start(); players get the current settings when they connect, and again whenever they change.
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/gorilla/websocket"
+)
+
+type page_settings struct {
+    background      Colour          // Canvas background, "" for transparent
+    image           string          // JS varname of a registered sprite, "" for none
+    image_mode      string          // "stretch", "centre" or "tile"
+    page_colour     Colour
+    hide_border     bool
+    hide_stats      bool
+}
+
+func SetBackground(colour Colour) {             // "" for none, i.e. the page colour shows through. Gradients and patterns are fine
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+    eng.page.background = colour
+    send_page_settings()
+}
+
+func SetBackgroundImage(filename, mode string) {
+
+    // Draws a registered sprite behind everything, ignoring the camera. The mode is "stretch"
+    // (to fill the canvas), "centre" or "tile". An empty filename removes it.
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    if mode != "centre" && mode != "tile" {
+        mode = "stretch"
+    }
+
+    eng.page.image = eng.sprites[filename]
+    eng.page.image_mode = mode
+    send_page_settings()
+}
+
+func SetPageColour(colour Colour) {             // The colour around the canvas, black by default
+
+    // This one goes to CSS, which can't use our gradients and patterns.
+
+    if strings.HasPrefix(colour, "~") {
+        fmt.Printf("wsworld: SetPageColour(): gradients and patterns can't be used\n")
+        return
+    }
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+    eng.page.page_colour = colour
+    send_page_settings()
+}
+
+func ShowBorder(b bool) {                       // The dashed border around the canvas
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+    eng.page.hide_border = !b
+    send_page_settings()
+}
+
+func ShowStats(b bool) {                        // The frame and draw counters above the canvas
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+    eng.page.hide_stats = !b
+    send_page_settings()
+}
+
+func page_settings_message() []byte {           // Caller must hold the engine mutex
+
+    p := eng.page
+
+    page_colour := p.page_colour
+    if page_colour == "" {
+        page_colour = BLACK
+    }
+
+    return []byte(fmt.Sprintf("b\x1e%s\x1e%s\x1e%s\x1e%s\x1e%s\x1e%s",
+        colour_wire_or_none(p.background), p.image, p.image_mode, colour_wire(page_colour), one_or_zero(!p.hide_border), one_or_zero(!p.hide_stats)))
+}
+
+func send_page_settings() {                     // Caller must hold the engine mutex
+    msg := page_settings_message()
+    for _, player := range eng.players {
+        player.conn.WriteMessage(websocket.TextMessage, msg)
+    }
+}
+
+func one_or_zero(b bool) string {
+    if b {
+        return "1"
+    }
+    return "0"
+}
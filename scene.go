@@ -0,0 +1,218 @@
+package wsworld
+
+// A Scene is the retained-mode alternative to a Canvas. The game creates entities once and
+// then just changes their fields; each SendToAll() sends only the entities that were created,
+// changed or removed since the last one (players who connect later get everything). The client
+// keeps drawing the entities it has, moving them at their speeds, until told otherwise.
+//
+// As in the old days:
+// Creating and removing entities is thread-safe.
+// Operating on different entities concurrently is thread-safe.
+// Operating on the same entity concurrently is NOT thread-safe, nor is changing an entity's
+// fields while the scene is being sent.
+
+import (
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/gorilla/websocket"
+)
+
+var scene_id_counter safe_counter_struct
+
+type Entity struct {
+    X               float64
+    Y               float64
+    Speedx          float64
+    Speedy          float64
+    Colour          Colour          // Points, circles and text
+    Radius          float64         // Circles
+    Text            string          // Text
+    Size            int             // Text
+    Font            string          // Text
+    Sprite          SpriteOptions   // Sprites
+    Layer           int
+    Hidden          bool
+
+    id              int
+    kind            rune            // What sort of thing this is
+    filename        string          // For sprites only
+    scene           *Scene
+}
+
+type Scene struct {
+    mutex           sync.Mutex
+    id              int
+    next_entity_id  int
+    entities        map[int]*Entity
+    last            map[int]string      // entity id -> what was last sent for it
+    synced          map[int]bool        // pid -> player has had the whole scene
+}
+
+func NewScene() *Scene {
+    ret := new(Scene)
+    ret.id = scene_id_counter.Next()
+    ret.entities = make(map[int]*Entity)
+    ret.last = make(map[int]string)
+    ret.synced = make(map[int]bool)
+    return ret
+}
+
+func (sc *Scene) add_entity(e *Entity) *Entity {
+
+    // e must be complete before this, since SendToAll() may read it as soon as it's in the scene.
+
+    sc.mutex.Lock()
+    defer sc.mutex.Unlock()
+
+    e.id = sc.next_entity_id
+    e.scene = sc
+    sc.next_entity_id += 1
+    sc.entities[e.id] = e
+
+    return e
+}
+
+func (sc *Scene) NewPoint(colour Colour, x, y, speedx, speedy float64) *Entity {
+    return sc.add_entity(&Entity{X: x, Y: y, Speedx: speedx, Speedy: speedy, Colour: colour, kind: 'p'})
+}
+
+func (sc *Scene) NewSprite(filename string, x, y, speedx, speedy float64) *Entity {      // Never sent if filename isn't registered
+    return sc.add_entity(&Entity{X: x, Y: y, Speedx: speedx, Speedy: speedy, filename: filename, kind: 's'})
+}
+
+func (sc *Scene) NewCircle(colour Colour, x, y, radius, speedx, speedy float64) *Entity {
+    return sc.add_entity(&Entity{X: x, Y: y, Speedx: speedx, Speedy: speedy, Colour: colour, Radius: radius, kind: 'c'})
+}
+
+func (sc *Scene) NewText(text string, colour Colour, size int, font string, x, y, speedx, speedy float64) *Entity {
+    return sc.add_entity(&Entity{X: x, Y: y, Speedx: speedx, Speedy: speedy, Text: text, Colour: colour, Size: size, Font: font, kind: 't'})
+}
+
+func (sc *Scene) RemoveAll() {
+    sc.mutex.Lock()
+    defer sc.mutex.Unlock()
+    sc.entities = make(map[int]*Entity)
+}
+
+func (e *Entity) Move() {
+    e.X += e.Speedx
+    e.Y += e.Speedy
+}
+
+func (e *Entity) Remove() {             // Removes from scene. Object still exists but can never be drawn.
+    e.scene.mutex.Lock()
+    defer e.scene.mutex.Unlock()
+    delete(e.scene.entities, e.id)
+}
+
+func (e *Entity) Exists() bool {
+    e.scene.mutex.Lock()
+    defer e.scene.mutex.Unlock()
+    _, ok := e.scene.entities[e.id]
+    return ok
+}
+
+func (e *Entity) blob() string {
+
+    // <layer> (31) <the same blob a Canvas would send>, or "" if it can't be drawn
+
+    var b string
+
+    switch e.kind {
+    case 'p':
+        b = point_blob(e.Colour, e.X, e.Y, e.Speedx, e.Speedy)
+    case 's':
+        if eng.sprites[e.filename] == "" {      // Safe to read without mutex since there are no writes any more
+            return ""
+        }
+        b = sprite_ex_blob(e.filename, e.X, e.Y, e.Speedx, e.Speedy, e.Sprite)
+    case 'c':
+        b = circle_blob(e.Colour, true, e.X, e.Y, e.Radius, e.Speedx, e.Speedy)
+    case 't':
+        b = text_blob(e.Text, e.Colour, e.Size, e.Font, e.X, e.Y, e.Speedx, e.Speedy)
+    }
+
+    return strconv.Itoa(e.Layer) + "\x1f" + b
+}
+
+func (sc *Scene) SendToAll() {
+
+    // Message format: E (30) scene id (30) 1 if whole scene else 0 (30) entries...
+    // where each entry is either <entity id> (31) <blob> or -<entity id> for a removal.
+
+    all, delta := sc.diff()
+
+    header := "E\x1e" + strconv.Itoa(sc.id) + "\x1e"
+    full_message := []byte(strings.Join(append([]string{header + "1"}, all...), "\x1e"))
+    delta_message := []byte(strings.Join(append([]string{header + "0"}, delta...), "\x1e"))
+
+    eng.mutex.Lock()
+    defer eng.mutex.Unlock()
+
+    sc.mutex.Lock()                     // For sc.synced
+    defer sc.mutex.Unlock()
+
+    for pid, player := range eng.players {
+        if sc.synced[pid] == false {
+            player.conn.WriteMessage(websocket.TextMessage, full_message)
+            sc.synced[pid] = true
+        } else if len(delta) > 0 {
+            player.conn.WriteMessage(websocket.TextMessage, delta_message)
+        }
+    }
+
+    for pid := range sc.synced {
+        if eng.players[pid] == nil {
+            delete(sc.synced, pid)
+        }
+    }
+}
+
+func (sc *Scene) diff() (all []string, delta []string) {
+
+    // The entries for the whole scene, and for what changed since the last call. Hidden
+    // entities, and any that can't be drawn, count as removed.
+
+    sc.mutex.Lock()
+    defer sc.mutex.Unlock()
+
+    current := make(map[int]string)
+
+    for id, e := range sc.entities {
+        if e.Hidden == false {
+            if b := e.blob(); b != "" {
+                current[id] = b
+            }
+        }
+    }
+
+    for _, id := range sorted_keys(current) {
+        entry := strconv.Itoa(id) + "\x1f" + current[id]
+        all = append(all, entry)
+        if sc.last[id] != current[id] {
+            delta = append(delta, entry)
+        }
+    }
+
+    for id := range sc.last {
+        if _, ok := current[id]; ok == false {
+            delta = append(delta, "-" + strconv.Itoa(id))
+        }
+    }
+
+    sc.last = current
+
+    return all, delta
+}
+
+func sorted_keys(m map[int]string) []int {
+    var ret []int
+    for key := range m {
+        ret = append(ret, key)
+    }
+    sort.Ints(ret)
+    return ret
+}
@@ -0,0 +1,109 @@
+package wsworld
+
+import (
+    "sort"
+    "strings"
+    "testing"
+)
+
+func entry_ids(entries []string) string {
+
+    // "0 1 -2" and so on: each entry's id, or -id for removals, sorted.
+
+    var ids []string
+    for _, entry := range entries {
+        ids = append(ids, strings.SplitN(entry, "\x1f", 2)[0])
+    }
+    sort.Strings(ids)
+    return strings.Join(ids, " ")
+}
+
+func TestSceneDiff(t *testing.T) {
+
+    sc := NewScene()
+
+    var a, b *Entity
+
+    // Each step changes the scene, then checks what the next diff says. Steps run in order.
+
+    steps := []struct {
+        name            string
+        change          func()
+        want_all        string
+        want_delta      string
+    }{
+        {"create", func() {
+            a = sc.NewCircle(RED, 1, 2, 3, 0, 0)
+            b = sc.NewPoint(BLUE, 4, 5, 0, 0)
+        }, "0 1", "0 1"},
+        {"nothing", func() {}, "0 1", ""},
+        {"move", func() { a.X = 10 }, "0 1", "0"},
+        {"move back and forth", func() { a.X = 11; a.X = 10 }, "0 1", ""},
+        {"layer", func() { b.Layer = 5 }, "0 1", "1"},
+        {"hide", func() { b.Hidden = true }, "0", "-1"},
+        {"still hidden", func() {}, "0", ""},
+        {"unhide", func() { b.Hidden = false }, "0 1", "1"},
+        {"remove", func() { a.Remove() }, "1", "-0"},
+        {"change removed", func() { a.X = 20 }, "1", ""},
+        {"remove all", func() { sc.RemoveAll() }, "", "-1"},
+        {"empty", func() {}, "", ""},
+        {"unregistered sprite", func() { sc.NewSprite("no_such_file.png", 0, 0, 0, 0) }, "", ""},
+    }
+
+    for _, step := range steps {
+
+        step.change()
+        all, delta := sc.diff()
+
+        if got := entry_ids(all); got != step.want_all {
+            t.Errorf("%s: all is %q, want %q", step.name, got, step.want_all)
+        }
+
+        if got := entry_ids(delta); got != step.want_delta {
+            t.Errorf("%s: delta is %q, want %q", step.name, got, step.want_delta)
+        }
+    }
+}
+
+func TestSceneEntryFormat(t *testing.T) {
+
+    sc := NewScene()
+    e := sc.NewCircle(RED, 1, 2, 3, 0, 0)
+    e.Layer = -3
+
+    all, _ := sc.diff()
+
+    if len(all) != 1 || strings.HasPrefix(all[0], "0\x1f-3\x1fc\x1f") == false {
+        t.Errorf("got %q, want entity 0, layer -3, a circle", all)
+    }
+}
+
+func TestSceneCreateWhileSending(t *testing.T) {
+
+    // Run with -race. Entities must be complete by the time a diff can see them.
+
+    sc := NewScene()
+    done := make(chan bool)
+
+    go func() {
+        for n := 0; n < 5000; n++ {
+            sc.NewCircle(RED, 1, 2, 3, 0, 0)
+            sc.NewText("hi", BLUE, 12, "Arial", 0, 0, 0, 0)
+        }
+        done <- true
+    }()
+
+    for {
+        all, _ := sc.diff()
+        for _, entry := range all {
+            if strings.Contains(entry, "\x1f#f0f\x1f") {
+                t.Fatalf("entity sent before its colour was set: %q", entry)
+            }
+        }
+        select {
+        case <-done:
+            return
+        default:
+        }
+    }
+}
@@ -0,0 +1,172 @@
+package wsworld
+
+// A Tilemap is a grid of tiles from a sprite sheet. The client keeps its own copy of the grid:
+// the first time a player is sent a canvas containing the tilemap, they get the whole grid,
+// and after that only the tiles that changed. So drawing a large level costs almost nothing
+// per frame. The client only draws the tiles that are on screen, taking the camera into account.
+
+import (
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/gorilla/websocket"
+)
+
+const TILEMAP_LOG_MAX = 4096            // Changes remembered; players further behind get the whole grid again
+
+var tilemap_id_counter safe_counter_struct
+
+type tile_change struct {
+    index           int
+    tile            int
+}
+
+type Tilemap struct {
+    mutex           sync.Mutex
+    id              int
+    varname         string
+    cols            int
+    rows            int
+    tiles           []int
+
+    version         int                 // Number of changes ever made
+    log             []tile_change       // The most recent changes, the last being change number version
+    sent            map[int]int         // pid -> version that player has
+}
+
+func NewTilemap(sheet_filename string, cols, rows int) *Tilemap {
+
+    // All tiles start empty (-1). Otherwise tiles are frame numbers in the sheet, which must have
+    // been registered with RegisterSpriteSheet(); its frame size is the tile size.
+
+    if _, ok := eng.sheets[sheet_filename]; ok == false {       // Safe to read without mutex since there are no writes any more
+        panic("NewTilemap(): not a registered sprite sheet")
+    }
+
+    if cols <= 0 || rows <= 0 {
+        panic("NewTilemap(): bad size")
+    }
+
+    ret := new(Tilemap)
+    ret.id = tilemap_id_counter.Next()
+    ret.varname = eng.sprites[sheet_filename]
+    ret.cols = cols
+    ret.rows = rows
+    ret.tiles = make([]int, cols * rows)
+    ret.sent = make(map[int]int)
+
+    for n := range ret.tiles {
+        ret.tiles[n] = -1
+    }
+
+    return ret
+}
+
+func (t *Tilemap) Set(col, row, tile int) {
+
+    if col < 0 || col >= t.cols || row < 0 || row >= t.rows {
+        return
+    }
+
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    index := row * t.cols + col
+
+    if t.tiles[index] == tile {
+        return
+    }
+
+    t.tiles[index] = tile
+    t.version += 1
+    t.log = append(t.log, tile_change{index, tile})
+
+    if len(t.log) > TILEMAP_LOG_MAX {
+        t.log = t.log[len(t.log) - TILEMAP_LOG_MAX:]
+    }
+}
+
+func (t *Tilemap) Get(col, row int) int {
+
+    if col < 0 || col >= t.cols || row < 0 || row >= t.rows {
+        return -1
+    }
+
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    return t.tiles[row * t.cols + col]
+}
+
+func (w *Canvas) AddTilemap(t *Tilemap, x, y float64) {       // x, y is the top left corner of the map
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.entities = append(w.entities, "m\x1f" + strconv.Itoa(t.id) + "\x1f" + strconv.FormatFloat(x, 'f', 1, 64) + "\x1f" + strconv.FormatFloat(y, 'f', 1, 64))
+    w.tilemaps = append(w.tilemaps, t)
+}
+
+func (t *Tilemap) sync_to(p *player) {                 // Caller must hold the engine mutex
+
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    have, ok := t.sent[p.pid]
+
+    if msg := t.update_message(have, ok); msg != nil {
+        p.conn.WriteMessage(websocket.TextMessage, msg)
+    }
+
+    t.sent[p.pid] = t.version
+}
+
+func (t *Tilemap) update_message(have int, ok bool) []byte {       // Caller must hold the tilemap mutex
+
+    // What a player who has version have needs (ok is false if they have nothing), or nil.
+
+    if ok && have == t.version {
+        return nil
+    }
+
+    oldest := t.version - len(t.log)        // The version just before the first logged change
+
+    if ok == false || have < oldest {
+        return t.full_message()
+    }
+
+    return t.delta_message(t.log[have - oldest:])
+}
+
+func (t *Tilemap) forget_departed() {                  // Caller must hold the engine mutex
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    for pid := range t.sent {
+        if eng.players[pid] == nil {
+            delete(t.sent, pid)
+        }
+    }
+}
+
+func (t *Tilemap) full_message() []byte {
+
+    // M (30) id (30) varname (30) cols (30) rows (30) tile,tile,tile...
+
+    parts := make([]string, len(t.tiles))
+    for n, tile := range t.tiles {
+        parts[n] = strconv.Itoa(tile)
+    }
+
+    return []byte(strings.Join([]string{"M", strconv.Itoa(t.id), t.varname, strconv.Itoa(t.cols), strconv.Itoa(t.rows), strings.Join(parts, ",")}, "\x1e"))
+}
+
+func (t *Tilemap) delta_message(changes []tile_change) []byte {
+
+    // N (30) id (30) index,tile,index,tile...
+
+    parts := make([]string, 0, len(changes) * 2)
+    for _, c := range changes {
+        parts = append(parts, strconv.Itoa(c.index), strconv.Itoa(c.tile))
+    }
+
+    return []byte(strings.Join([]string{"N", strconv.Itoa(t.id), strings.Join(parts, ",")}, "\x1e"))
+}
@@ -0,0 +1,108 @@
+package wsworld
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func test_tilemap(t *testing.T, changes int) *Tilemap {
+
+    // A map big enough that every change is to a different tile.
+
+    RegisterSpriteSheet("test_tiles.png", 16, 16)
+
+    tm := NewTilemap("test_tiles.png", 100, 100)
+
+    for n := 0; n < changes; n++ {
+        tm.Set(n % 100, n / 100, n)
+    }
+
+    if tm.version != changes {
+        t.Fatalf("version %d after %d changes", tm.version, changes)
+    }
+
+    return tm
+}
+
+func TestTilemapUpdateMessage(t *testing.T) {
+
+    total := TILEMAP_LOG_MAX + 10
+    tm := test_tilemap(t, total)
+
+    if len(tm.log) != TILEMAP_LOG_MAX {
+        t.Fatalf("log length %d, want %d", len(tm.log), TILEMAP_LOG_MAX)
+    }
+
+    oldest := total - TILEMAP_LOG_MAX
+
+    tests := []struct {
+        name            string
+        have            int
+        ok              bool
+        want_type       string          // "" for no message
+        want_changes    int             // For deltas
+    }{
+        {"never synced", 0, false, "M", 0},
+        {"up to date", total, true, "", 0},
+        {"one behind", total - 1, true, "N", 1},
+        {"three behind", total - 3, true, "N", 3},
+        {"at oldest logged", oldest, true, "N", TILEMAP_LOG_MAX},
+        {"before oldest logged", oldest - 1, true, "M", 0},
+        {"from the start", 0, true, "M", 0},
+    }
+
+    for _, test := range tests {
+
+        msg := tm.update_message(test.have, test.ok)
+
+        if test.want_type == "" {
+            if msg != nil {
+                t.Errorf("%s: got %q, want nothing", test.name, msg)
+            }
+            continue
+        }
+
+        parts := strings.Split(string(msg), "\x1e")
+
+        if parts[0] != test.want_type {
+            t.Errorf("%s: got type %q, want %q", test.name, parts[0], test.want_type)
+            continue
+        }
+
+        if test.want_type == "M" {
+            if len(strings.Split(parts[5], ",")) != 100 * 100 {
+                t.Errorf("%s: full message has the wrong number of tiles", test.name)
+            }
+            continue
+        }
+
+        pairs := strings.Split(parts[2], ",")
+
+        if len(pairs) != test.want_changes * 2 {
+            t.Errorf("%s: got %d changes, want %d", test.name, len(pairs) / 2, test.want_changes)
+            continue
+        }
+
+        // The changes must be the latest ones, ending with the very last.
+
+        first := total - test.want_changes
+
+        if pairs[1] != strconv.Itoa(first) || pairs[len(pairs) - 1] != strconv.Itoa(total - 1) {
+            t.Errorf("%s: changes run from tile %s to %s, want %d to %d", test.name, pairs[1], pairs[len(pairs) - 1], first, total - 1)
+        }
+    }
+}
+
+func TestTilemapUnchangedSetNotLogged(t *testing.T) {
+
+    tm := test_tilemap(t, 5)
+
+    tm.Set(0, 0, 0)         // Already 0
+    tm.Set(-1, 0, 7)        // Off the map
+    tm.Set(0, 100, 7)
+
+    if tm.version != 5 || len(tm.log) != 5 {
+        t.Errorf("version %d, log length %d, want 5 and 5", tm.version, len(tm.log))
+    }
+}
@@ -34,7 +34,7 @@ type Variables struct {
     SoundLoaders    string
 }
 
-func static_webpage(title, server, virtual_ws_path, virtual_res_path string, sprites map[string]string, sounds map[string]string, width, height int) string {
+func static_webpage(title, server, virtual_ws_path, virtual_res_path string, sprites map[string]string, sheets map[string]sheet, sounds map[string]string, width, height int) string {
 
     var imageloaders []string
     var soundloaders []string
@@ -43,6 +43,11 @@ func static_webpage(title, server, virtual_ws_path, virtual_res_path string, spr
         imageloaders = append(imageloaders, fmt.Sprintf(
             "var %s = new Image();\n%s.src = \"http://%s%s%s\";",
             varname, varname, server, virtual_res_path, filename))
+        if sh, ok := sheets[filename]; ok {
+            imageloaders = append(imageloaders, fmt.Sprintf(
+                "%s.frame_w = %d;\n%s.frame_h = %d;",
+                varname, sh.frame_w, varname, sh.frame_h))
+        }
     }
 
     for filename, varname := range sounds {
@@ -72,15 +77,22 @@ const WEBPAGE = `<!DOCTYPE html>
 <body style="background-color: black; width: 100%; height: 100%; margin: 0; padding: 0; overflow: hidden;">
 
 <p style="color: #66aa66; text-align: center; margin: 0.2em">
+<span id="stats">
 WebSocket frames: <span id="ws_frames">0</span>
 ---
 Total draws: <span id="total_draws">0</span>
+</span>
 
 <span id="debug_msg"></span>
 </p>
 
 {{.SoundLoaders}}
 
+<div id="text_prompt" style="display: none; position: fixed; left: 0; right: 0; top: 40%; text-align: center;">
+<span id="text_prompt_label" style="color: #cccccc"></span>
+<input id="text_prompt_input" type="text" autocomplete="off">
+</div>
+
 <canvas style="display: block; margin: 0 auto; border-style: dashed; border-color: #666666"></canvas>
 
 <script>
@@ -94,6 +106,8 @@ function start_wsworld_client() {
 
     var WIDTH = {{.Width}};
     var HEIGHT = {{.Height}};
+    var LAYER_HUD = 100;            // Layers from here up ignore the camera
+    var MAX_EFFECTS = 1000;
     var channel_max = 8;
     var canvas = document.querySelector("canvas");
     var virtue = canvas.getContext("2d");
@@ -106,6 +120,12 @@ function start_wsworld_client() {
     that.second_last_frame_time = Date.now() - 16;
     that.last_frame_time = Date.now();
     that.all_things = [];
+    that.frame_things = [];             // Whichever frame's things are being drawn
+    that.draw_list = [];
+    that.effects = [];
+    that.tilemaps = {};
+    that.camera = null;
+    that.hidden_layers = {};
 
     that.ws = new WebSocket("ws://{{.Server}}{{.WsPath}}");
     that.ws_ready = false;
@@ -127,7 +147,7 @@ function start_wsworld_client() {
 
             // Deal with visual frames.................................................................
 
-            that.all_things.length = 0;         // Clear our list of drawables.
+            that.all_things = [];               // A new list, since interpolation may be keeping the old one
 
             that.ws_frames += 1;
             that.second_last_frame_time = that.last_frame_time;
@@ -135,27 +155,116 @@ function start_wsworld_client() {
 
             // Cache the functions to cut down on indirection. Might offer a speedup? Who knows.
 
-            var parse_point_or_sprite = that.parse_point_or_sprite;
-            var parse_line = that.parse_line;
-            var parse_text = that.parse_text;
+            var parsers = that.parsers;
+            var parser;
+
+            // Some blobs don't draw anything but change the state that later things are drawn
+            // with. Each thing gets a reference to the state that was current when it arrived.
+            // State objects are never modified, only replaced.
+
+            that.parse_state = that.default_state();
+            that.group_stack = [];
+            that.hidden_layers = {};
+            that.camera = null;
+            that.interp_delay = 0;
+            that.next_id = null;
+
+            var start;
+            var k;
 
             for (n = 1; n < len; n += 1) {
 
+                start = that.all_things.length;
+
                 switch (stuff[n].charAt(0)) {
 
-                case "l":
-                    parse_line(stuff[n]);
+                case "z":
+                    that.parse_state = Object.assign({}, that.parse_state, {layer: parseInt(stuff[n].split(String.fromCharCode(31))[1], 10)});
+                    break;
+                case "k":
+                    that.parse_camera(stuff[n]);
+                    break;
+                case "w":
+                    that.parse_line_style(stuff[n]);
+                    break;
+                case "o":
+                    that.parse_point_style(stuff[n]);
+                    break;
+                case "T":
+                    that.parse_text_style(stuff[n]);
+                    break;
+                case "x":
+                    that.parse_shadow(stuff[n]);
+                    break;
+                case "q":
+                    that.parse_motion(stuff[n]);
+                    break;
+                case "G":
+                    that.parse_group(stuff[n]);
+                    if (that.next_id !== null) {
+                        that.parse_state.group.id = that.next_id;       // Groups can be matched across frames too
+                        that.next_id = null;
+                    }
+                    break;
+                case "U":
+                    if (that.group_stack.length > 0) {
+                        that.parse_state = that.group_stack.pop();      // Styles set in the group end with it
+                    }
+                    break;
+                case "e":
+                    that.parse_state = Object.assign({}, that.parse_state, {fade: parseFloat(stuff[n].split(String.fromCharCode(31))[1])});
+                    break;
+                case "F":
+                    that.parse_floating_text(stuff[n]);
                     break;
-                case "p":
-                case "s":
-                    parse_point_or_sprite(stuff[n]);
+                case "h":
+                    that.hidden_layers[parseInt(stuff[n].split(String.fromCharCode(31))[1], 10)] = true;
                     break;
-                case "t":
-                    parse_text(stuff[n]);
+                case "i":
+                    that.interp_delay = parseFloat(stuff[n].split(String.fromCharCode(31))[1]);
                     break;
+                case "n":
+                    that.next_id = stuff[n].split(String.fromCharCode(31))[1];
+                    break;
+                default:
+                    parser = parsers[stuff[n].charAt(0)];
+                    if (parser !== undefined) {
+                        parser(stuff[n]);
+                    }
+                }
+
+                for (k = start; k < that.all_things.length; k += 1) {
+                    that.all_things[k].state = that.parse_state;
+                }
+
+                if (that.next_id !== null && that.all_things.length > start && that.all_things[start].type !== "m") {     // Tilemaps don't move, so wait for the next thing
+                    that.all_things[start].id = that.next_id;
+                    that.next_id = null;
+                }
+
+                if (that.all_things.length > start && (that.parse_state.fade > 0 || that.all_things[start].life > 0)) {
+                    that.add_effects(that.all_things.splice(start));
                 }
             }
 
+            if (that.interp_delay > 0) {
+                that.add_snapshot();
+            } else {
+                that.snapshots.length = 0;
+                that.drawn_snapshot = null;
+                that.frame_things = that.all_things;
+                that.rebuild_draw_list();
+            }
+
+        } else if (frame_type === "E") {
+
+            // Retained-mode scene updates.............................................................
+
+            if (len > 2) {
+                that.update_scene(stuff);
+                that.rebuild_draw_list();
+            }
+
         } else if (frame_type === "a") {
 
             // Deal with audio events..................................................................
@@ -171,37 +280,273 @@ function start_wsworld_client() {
             if (len > 0) {
                 that.display_debug_message(stuff[1]);
             }
+
+        } else if (frame_type === "M") {
+
+            // A whole tilemap grid....................................................................
+
+            if (len > 5) {
+                that.tilemaps[stuff[1]] = {
+                    varname: stuff[2],
+                    cols: parseInt(stuff[3], 10),
+                    rows: parseInt(stuff[4], 10),
+                    tiles: stuff[5].split(",").map(Number)
+                };
+            }
+
+        } else if (frame_type === "N") {
+
+            // Changed tiles in a tilemap..............................................................
+
+            if (len > 2 && that.tilemaps[stuff[1]]) {
+                var tiles = that.tilemaps[stuff[1]].tiles;
+                var changes = stuff[2].split(",").map(Number);
+                for (n = 0; n + 1 < changes.length; n += 2) {
+                    tiles[changes[n]] = changes[n + 1];
+                }
+            }
+
+        } else if (frame_type === "b") {
+
+            // Page settings...........................................................................
+
+            if (len > 6) {
+                that.set_page(stuff);
+            }
+
+        } else if (frame_type === "m") {
+
+            // Pointer lock setting....................................................................
+
+            if (len > 1) {
+                that.set_pointer_lock_wanted(stuff[1] === "1");
+            }
+
+        } else if (frame_type === "i") {
+
+            // Text input requests.....................................................................
+
+            if (len > 2) {
+                that.open_text_prompt(stuff[1], parseInt(stuff[2], 10));
+            }
         }
     };
 
     // Setup keyboard and mouse...
+    // All input messages end with our timestamp, so the server can order them.
+
+    that.send_input = function (s) {
+        that.ws.send(s + " " + Date.now().toString());
+    };
+
+    that.key_message = function (type, evt) {
+
+        // <type> <key> <code> <modifier bits> <repeat>
+
+        var key = evt.key === " " ? "space" : evt.key;
+        var code = evt.code ? evt.code : "Unidentified";
+        var mods = (evt.shiftKey ? 1 : 0) + (evt.ctrlKey ? 2 : 0) + (evt.altKey ? 4 : 0) + (evt.metaKey ? 8 : 0);
+
+        return type + " " + key + " " + code + " " + mods.toString() + " " + (evt.repeat ? "1" : "0");
+    };
+
+    // Codes the server thinks are down. Their keyups are sent even while the text box is open,
+    // else a key held when it opened (e.g. the one that asked for it) would stay down forever.
+
+    that.held = {};
 
     document.addEventListener("keydown", function (evt) {
-        if (that.ws_ready) {
-            if (evt.key === " ") {
-                that.ws.send("keydown space");
-            } else {
-                that.ws.send("keydown " + evt.key);
-            }
+        if (that.ws_ready && that.text_open === false) {
+            that.send_input(that.key_message("keydown", evt));
+            that.held[evt.code] = true;
         }
     });
 
     document.addEventListener("keyup", function (evt) {
+        if (that.ws_ready && (that.text_open === false || that.held[evt.code])) {
+            that.send_input(that.key_message("keyup", evt));
+        }
+        delete that.held[evt.code];
+    });
+
+    // Text entry. While the box is open, keys go to it and not to the server...
+
+    that.text_open = false;
+
+    var text_prompt = document.getElementById("text_prompt");
+    var text_prompt_input = document.getElementById("text_prompt_input");
+
+    that.open_text_prompt = function (prompt, maxlen) {
+        document.getElementById("text_prompt_label").textContent = prompt;
+        text_prompt_input.maxLength = maxlen;
+        text_prompt_input.value = "";
+        text_prompt.style.display = "block";
+        text_prompt_input.focus();
+        that.text_open = true;
+    };
+
+    that.close_text_prompt = function () {
+        text_prompt.style.display = "none";
+        text_prompt_input.blur();
+        that.text_open = false;
+    };
+
+    text_prompt_input.addEventListener("keydown", function (evt) {
+        if (evt.repeat && that.held[evt.code]) {
+            evt.preventDefault();           // Still held from before the box opened, e.g. Enter-to-chat
+        } else if (evt.key === "Enter") {
+            that.send_input("text =" + encodeURIComponent(text_prompt_input.value));     // The = keeps "" from being an empty field
+            that.close_text_prompt();
+            evt.preventDefault();
+        } else if (evt.key === "Escape") {
+            that.send_input("textcancel");
+            that.close_text_prompt();
+            evt.preventDefault();
+        }
+        evt.stopPropagation();
+    });
+
+    text_prompt_input.addEventListener("keyup", function (evt) {
+        if (that.held[evt.code]) {
+            return;                 // Let the document's handler send it
+        }
+        evt.stopPropagation();
+    });
+
+    // If the page loses focus while a key is held, we never get the keyup. So tell the
+    // server, which will release all keys. Blur and visibilitychange often fire together.
+
+    that.focused = true;
+
+    that.set_focus = function (focused) {
+        if (that.ws_ready && focused !== that.focused) {
+            that.send_input("focus " + (focused ? "1" : "0"));
+        }
+        if (focused === false) {
+            that.held = {};         // The server releases them all
+        }
+        that.focused = focused;
+    };
+
+    window.addEventListener("blur", function () {
+        that.set_focus(false);
+    });
+
+    window.addEventListener("focus", function () {
+        that.set_focus(true);
+    });
+
+    document.addEventListener("visibilitychange", function () {
+        that.set_focus(document.visibilityState === "visible" && document.hasFocus());
+    });
+
+    // Translate a mouse event into logical canvas units, i.e. the width and height given to
+    // Start(), regardless of page scroll, CSS scaling, borders, or positioned parents.
+
+    that.canvas_coords = function (evt) {
+        var rect = canvas.getBoundingClientRect();
+        var x = (evt.clientX - rect.left - canvas.clientLeft) * WIDTH / canvas.clientWidth;
+        var y = (evt.clientY - rect.top - canvas.clientTop) * HEIGHT / canvas.clientHeight;
+        return {x: Math.floor(x), y: Math.floor(y)};
+    };
+
+    // Pointer lock. Browsers only allow it in response to a click. While locked, we add up
+    // the relative motion and send it once per animation frame...
+
+    that.pointer_lock_wanted = false;
+    that.mouse_dx = 0;
+    that.mouse_dy = 0;
+
+    that.set_pointer_lock_wanted = function (wanted) {
+        that.pointer_lock_wanted = wanted;
+        if (wanted === false && document.pointerLockElement === canvas) {
+            document.exitPointerLock();
+        }
+    };
+
+    document.addEventListener("pointerlockchange", function () {
         if (that.ws_ready) {
-            if (evt.key === " ") {
-                that.ws.send("keyup space");
-            } else {
-                that.ws.send("keyup " + evt.key);
-            }
+            that.send_input("pointerlock " + (document.pointerLockElement === canvas ? "1" : "0"));
+        }
+    });
+
+    document.addEventListener("mousemove", function (evt) {
+        if (document.pointerLockElement === canvas) {
+            that.mouse_dx += evt.movementX;
+            that.mouse_dy += evt.movementY;
         }
     });
 
+    that.send_mouse_delta = function () {
+        if (that.ws_ready && (that.mouse_dx !== 0 || that.mouse_dy !== 0)) {
+            that.send_input("mousedelta " + that.mouse_dx.toString() + " " + that.mouse_dy.toString());
+            that.mouse_dx = 0;
+            that.mouse_dy = 0;
+        }
+    };
+
     canvas.addEventListener("mousedown", function (evt) {
-        var x = evt.clientX - canvas.offsetLeft;
-        var y = evt.clientY - canvas.offsetTop;
-        that.ws.send("click " + evt.button.toString() + " " + x.toString() + " " + y.toString());
+        if (that.pointer_lock_wanted && document.pointerLockElement !== canvas && canvas.requestPointerLock) {
+            canvas.requestPointerLock();
+        }
+        var pos = that.canvas_coords(evt);
+        that.send_input("click " + evt.button.toString() + " " + pos.x.toString() + " " + pos.y.toString());
+    });
+
+    // Gamepads can't be listened to, only polled. We remember the last state we sent
+    // for each pad and only send changes...
+
+    that.pad_states = {};
+
+    window.addEventListener("gamepaddisconnected", function (evt) {
+        delete that.pad_states[evt.gamepad.index];
+        if (that.ws_ready) {
+            that.send_input("padgone " + evt.gamepad.index.toString());
+        }
     });
 
+    that.poll_gamepads = function () {
+
+        if (that.ws_ready === false || !navigator.getGamepads) {
+            return;
+        }
+
+        var pads = navigator.getGamepads();
+        var n;
+        var i;
+
+        for (n = 0; n < pads.length; n += 1) {
+
+            var pad = pads[n];
+
+            if (!pad) {
+                continue;
+            }
+
+            if (that.pad_states[pad.index] === undefined) {
+                that.pad_states[pad.index] = {buttons: [], axes: []};
+            }
+
+            var state = that.pad_states[pad.index];
+
+            for (i = 0; i < pad.buttons.length; i += 1) {
+                var pressed = pad.buttons[i].pressed;
+                if (state.buttons[i] !== pressed) {
+                    state.buttons[i] = pressed;
+                    that.send_input("padbutton " + pad.index.toString() + " " + i.toString() + " " + (pressed ? "1" : "0"));
+                }
+            }
+
+            for (i = 0; i < pad.axes.length; i += 1) {
+                var value = pad.axes[i].toFixed(2);        // Rounding stops noise from flooding the socket
+                if (state.axes[i] !== value) {
+                    state.axes[i] = value;
+                    that.send_input("padaxis " + pad.index.toString() + " " + i.toString() + " " + value);
+                }
+            }
+        }
+    };
+
     that.parse_point_or_sprite = function (blob) {
 
         var elements = blob.split(String.fromCharCode(31));
@@ -265,126 +610,1302 @@ function start_wsworld_client() {
         that.all_things.push(thing);
     };
 
-    that.draw_text = function(t, time_offset) {
-        var x = Math.floor(t.x + t.speedx * time_offset / 1000);
-        var y = Math.floor(t.y + t.size / 2 + t.speedy * time_offset / 1000);
+    // Scenes are kept until changed, unlike the things in visual frames. Each entity is a thing
+    // like any other, plus the time it arrived, which is what it's extrapolated from.
 
-        virtue.fillStyle = t.colour;
-        virtue.textAlign = "center";
-        virtue.font = t.size.toString() + "px " + t.font;
-        virtue.fillText(t.text, x, y);
-    };
+    that.scenes = {};
 
-    that.draw_point = function (p, time_offset) {
-        var x = Math.floor(p.x + p.speedx * time_offset / 1000);
-        var y = Math.floor(p.y + p.speedy * time_offset / 1000);
-        virtue.fillStyle = p.colour;
-        virtue.fillRect(x, y, 1, 1);
-    };
+    that.update_scene = function (stuff) {
 
-    that.draw_sprite = function (sp, time_offset) {
-        var x = sp.x + sp.speedx * time_offset / 1000;
-        var y = sp.y + sp.speedy * time_offset / 1000;
-        virtue.drawImage(window[sp.varname], x - window[sp.varname].width / 2, y - window[sp.varname].height / 2);
-    };
+        var scene_id = stuff[1];
+        var n;
 
-    that.draw_line = function (li, time_offset) {
-        var x1 = li.x1 + li.speedx * time_offset / 1000;
-        var y1 = li.y1 + li.speedy * time_offset / 1000;
-        var x2 = li.x2 + li.speedx * time_offset / 1000;
-        var y2 = li.y2 + li.speedy * time_offset / 1000;
+        if (stuff[2] === "1" || that.scenes[scene_id] === undefined) {
+            that.scenes[scene_id] = {};
+        }
 
-        virtue.strokeStyle = li.colour;
-        virtue.beginPath();
-        virtue.moveTo(x1, y1);
-        virtue.lineTo(x2, y2);
-        virtue.stroke();
-    };
+        var scene = that.scenes[scene_id];
+        var now = Date.now();
 
-    that.draw = function () {
+        for (n = 3; n < stuff.length; n += 1) {
 
-        virtue.clearRect(0, 0, WIDTH, HEIGHT);     // The best way to clear the canvas??
+            var entry = stuff[n];
 
-        // As a relatively simple way of dealing with arbitrary timings of incoming data, we
-        // always try to draw the object "where it is now" taking into account how long it's
-        // been since we received info about it. This is done with this "time_offset" var.
+            if (entry.charAt(0) === "-") {
+                delete scene[entry.slice(1)];
+                continue;
+            }
 
-        var time_offset = Date.now() - that.last_frame_time;
+            // <entity id> (31) <layer> (31) <blob>
 
-        // Cache various things for speed reasons...
+            var first = entry.indexOf(String.fromCharCode(31));
+            var second = entry.indexOf(String.fromCharCode(31), first + 1);
 
-        var all_things = that.all_things;
-        var len = all_things.length;
+            var blob = entry.slice(second + 1);
+            var parser = that.parsers[blob.charAt(0)];
 
-        var draw_point = that.draw_point;
-        var draw_sprite = that.draw_sprite;
-        var draw_line = that.draw_line;
-        var draw_text = that.draw_text;
+            if (parser === undefined) {
+                continue;
+            }
+
+            var start = that.all_things.length;
+            parser(blob);
+
+            if (that.all_things.length > start) {
+                var thing = that.all_things.pop();
+                thing.state = Object.assign(that.default_state(), {layer: parseInt(entry.slice(first + 1, second), 10)});
+                thing.received = now;
+                thing.entity_id = parseInt(entry.slice(0, first), 10);
+                scene[entry.slice(0, first)] = thing;
+            }
+        }
+    };
+
+    // Interpolation mode. Rather than extrapolating from the latest frame, we keep a few frames
+    // and draw interp_delay ms in the past, blending between the two frames either side of that
+    // moment. Things are matched across frames by their ids; things without ids are extrapolated
+    // from the older frame as usual.
+
+    that.interp_delay = 0;
+    that.snapshots = [];
+    that.drawn_snapshot = null;
 
+    var LERP_FIELDS = ["x", "y", "x1", "y1", "x2", "y2", "radius", "width", "height", "scalex", "scaley", "alpha", "zoom", "scale"];
+
+    // While drawing, the newer snapshot and how far we are towards it, for blending groups.
+
+    that.interp_newer = null;
+    that.interp_t = 0;
+
+    that.add_snapshot = function () {
+
+        var by_id = {};
+        var groups_by_id = {};
+        var group;
         var n;
-        for (n = 0; n < len; n += 1) {
 
-            switch (all_things[n].type) {
-            case "l":
-                draw_line(all_things[n], time_offset);
-                break;
-            case "p":
-                draw_point(all_things[n], time_offset);
-                break;
-            case "s":
-                draw_sprite(all_things[n], time_offset);
-                break;
-            case "t":
-                draw_text(all_things[n], time_offset);
-                break;
+        for (n = 0; n < that.all_things.length; n += 1) {
+            if (that.all_things[n].id !== undefined) {
+                by_id[that.all_things[n].id] = that.all_things[n];
+            }
+            for (group = that.all_things[n].state.group; group !== null; group = group.parent) {
+                if (group.id !== undefined) {
+                    groups_by_id[group.id] = group;
+                }
             }
         }
+
+        that.snapshots.push({time: that.last_frame_time, things: that.all_things, camera: that.camera, by_id: by_id, groups_by_id: groups_by_id});
+
+        if (that.snapshots.length > 30) {
+            that.snapshots.shift();
+        }
     };
 
-    that.animate = function () {
+    that.choose_snapshots = function (render_time) {
 
-        if (that.ws_frames > 0) {
-            that.total_draws += 1;
+        // Returns [older, newer] around render_time. Newer is null if we've run out of frames,
+        // in which case the caller extrapolates from older.
+
+        var snaps = that.snapshots;
+
+        while (snaps.length > 2 && snaps[1].time <= render_time) {
+            snaps.shift();
         }
 
-        if (that.total_draws % 10 === 0) {
-            document.getElementById("ws_frames").innerHTML = that.ws_frames;
-            document.getElementById("total_draws").innerHTML = that.total_draws;
+        if (snaps.length >= 2 && snaps[1].time > render_time) {
+            return [snaps[0], snaps[1]];
         }
 
-        that.draw();
-        requestAnimationFrame(that.animate);
+        return [snaps[snaps.length - 1], null];
     };
 
-    that.display_debug_message = function (s) {
-        document.getElementById("debug_msg").innerHTML = "--- " + s;
+    that.blend = function (a, b, t) {
+
+        var c = Object.assign({}, a);
+        var f;
+        var n;
+
+        for (n = 0; n < LERP_FIELDS.length; n += 1) {
+            f = LERP_FIELDS[n];
+            if (typeof a[f] === "number" && typeof b[f] === "number") {
+                c[f] = a[f] + (b[f] - a[f]) * t;
+            }
+        }
+
+        if (typeof a.angle === "number" && typeof b.angle === "number") {
+            var diff = Math.atan2(Math.sin(b.angle - a.angle), Math.cos(b.angle - a.angle));   // The short way round
+            c.angle = a.angle + diff * t;
+        }
+
+        if (a.points && b.points && a.points.length === b.points.length) {
+            c.points = [];
+            for (n = 0; n < a.points.length; n += 1) {
+                c.points.push(a.points[n] + (b.points[n] - a.points[n]) * t);
+            }
+        }
+
+        c.speedx = 0;
+        c.speedy = 0;
+        c.spin = 0;
+
+        return c;
     };
 
-    // Sound from Thomas Sturm: http://www.storiesinflight.com/html5/audio.html
+    that.rebuild_draw_list = function () {
 
-    that.init_sound = function () {
-        that.audiochannels = [];
-        while (that.audiochannels.length < channel_max) {
-            that.audiochannels.push({channel: new Audio(), finished: -1});
+        // Everything to draw, from the visual frame being drawn and all scenes, in layer order.
+        // Within a layer, visual frame things come first, then scenes in entity order.
+
+        var list = that.frame_things.slice();
+        var scene_id;
+        var entity_id;
+        var entities;
+
+        for (scene_id in that.scenes) {
+            entities = [];
+            for (entity_id in that.scenes[scene_id]) {
+                entities.push(that.scenes[scene_id][entity_id]);
+            }
+            entities.sort(function (a, b) {
+                return a.entity_id - b.entity_id;
+            });
+            list = list.concat(entities);
         }
+
+        list = list.filter(function (thing) {
+            return !that.hidden_layers[thing.state.layer];
+        });
+
+        list.sort(function (a, b) {         // Array sort is stable in modern browsers
+            return a.state.layer - b.state.layer;
+        });
+
+        that.draw_list = list;
     };
 
-    that.play_multi_sound = function (s) {
-        var a;
-        var thistime;
+    that.parse_tilemap = function (blob) {
 
-        for (a = 0; a < that.audiochannels.length; a += 1) {
-            thistime = new Date();
-            if (that.audiochannels[a].finished < thistime.getTime()) {
-                that.audiochannels[a].finished = thistime.getTime() + document.getElementById(s).duration * 1000;
-                that.audiochannels[a].channel.src = document.getElementById(s).src;
-                that.audiochannels[a].channel.load();
-                that.audiochannels[a].channel.play();
-                break;
+        var elements = blob.split(String.fromCharCode(31));
+
+        var thing = {};
+
+        thing.type = elements[0];
+        thing.map_id = elements[1];     // Not .id, which interpolation uses
+        thing.x = parseFloat(elements[2]);
+        thing.y = parseFloat(elements[3]);
+
+        that.all_things.push(thing);
+    };
+
+    that.parse_floating_text = function (blob) {
+
+        // Sent as F, life, then the same fields as t. Becomes an ordinary text thing which
+        // rises as it fades.
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        if (elements.length < 10) {
+            return;
+        }
+
+        var life = parseFloat(elements[1]);
+
+        that.parse_text("t" + blob.slice(blob.indexOf(String.fromCharCode(31), 2)));
+
+        var thing = that.all_things[that.all_things.length - 1];
+        thing.life = life;
+    };
+
+    that.add_effects = function (things) {
+        var now = Date.now();
+        var n;
+        for (n = 0; n < things.length; n += 1) {
+            things[n].born = now;
+            if (!(things[n].life > 0)) {
+                things[n].life = things[n].state.fade;
             }
+            that.effects.push(things[n]);
+        }
+        if (that.effects.length > MAX_EFFECTS) {
+            that.effects.splice(0, that.effects.length - MAX_EFFECTS);
         }
     };
 
+    that.default_state = function () {
+        return {
+            layer: 0,
+            fade: 0,
+            line_width: 1,
+            dash: [],
+            cap: "butt",
+            join: "miter",
+            point_size: 1,
+            point_round: false,
+            text_align: "center",
+            text_baseline: "",
+            outline_colour: "",
+            shadow_colour: "",
+            shadow_blur: 0,
+            shadow_x: 0,
+            shadow_y: 0,
+            outline_width: 0,
+            max_width: 0,
+            line_height: 1.2,
+            accel_x: 0,
+            accel_y: 0,
+            spin: 0,
+            group: null
+        };
+    };
+
+    that.parse_camera = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        that.camera = {
+            x: parseFloat(elements[1]),
+            y: parseFloat(elements[2]),
+            zoom: parseFloat(elements[3]),
+            angle: parseFloat(elements[4]),
+            speedx: parseFloat(elements[5]),
+            speedy: parseFloat(elements[6])
+        };
+    };
+
+    that.parse_line_style = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        var dash = elements[2] === "" ? [] : elements[2].split(",").map(parseFloat);
+
+        that.parse_state = Object.assign({}, that.parse_state, {
+            line_width: parseFloat(elements[1]),
+            dash: dash,
+            cap: elements[3],
+            join: elements[4]
+        });
+    };
+
+    that.parse_point_style = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        that.parse_state = Object.assign({}, that.parse_state, {
+            point_size: parseFloat(elements[1]),
+            point_round: elements[2] === "round"
+        });
+    };
+
+    that.parse_motion = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        that.parse_state = Object.assign({}, that.parse_state, {
+            accel_x: parseFloat(elements[1]),
+            accel_y: parseFloat(elements[2]),
+            spin: parseFloat(elements[3])
+        });
+    };
+
+    that.parse_group = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        that.group_stack.push(that.parse_state);
+
+        that.parse_state = Object.assign({}, that.parse_state, {
+            group: {
+                x: parseFloat(elements[1]),
+                y: parseFloat(elements[2]),
+                angle: parseFloat(elements[3]),
+                scale: parseFloat(elements[4]),
+                speedx: parseFloat(elements[5]),
+                speedy: parseFloat(elements[6]),
+                parent: that.parse_state.group
+            }
+        });
+    };
+
+    that.parse_text_style = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        that.parse_state = Object.assign({}, that.parse_state, {
+            text_align: elements[1],
+            text_baseline: elements[2],
+            outline_colour: elements[3],
+            outline_width: parseFloat(elements[4]),
+            max_width: parseFloat(elements[5]),
+            line_height: parseFloat(elements[6])
+        });
+    };
+
+    that.parse_shadow = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        that.parse_state = Object.assign({}, that.parse_state, {
+            shadow_colour: elements[1],
+            shadow_blur: parseFloat(elements[2]),
+            shadow_x: parseFloat(elements[3]),
+            shadow_y: parseFloat(elements[4])
+        });
+    };
+
+    that.parse_points = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        var thing = {};
+
+        thing.type = elements[0];
+        thing.colour = elements[1];
+        thing.values = elements[2].split(",").map(parseFloat);     // x, y, speedx, speedy, x, y, ...
+
+        that.all_things.push(thing);
+    };
+
+    that.parse_circle = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        var thing = {};
+
+        thing.type = elements[0];
+        thing.colour = elements[1];
+        thing.fill = elements[2] === "f";
+        thing.x = parseFloat(elements[3]);
+        thing.y = parseFloat(elements[4]);
+        thing.radius = parseFloat(elements[5]);
+        thing.speedx = parseFloat(elements[6]);
+        thing.speedy = parseFloat(elements[7]);
+
+        that.all_things.push(thing);
+    };
+
+    that.parse_rect = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        var thing = {};
+
+        thing.type = elements[0];
+        thing.colour = elements[1];
+        thing.fill = elements[2] === "f";
+        thing.x = parseFloat(elements[3]);
+        thing.y = parseFloat(elements[4]);
+        thing.width = parseFloat(elements[5]);
+        thing.height = parseFloat(elements[6]);
+        thing.radius = parseFloat(elements[7]);
+        thing.speedx = parseFloat(elements[8]);
+        thing.speedy = parseFloat(elements[9]);
+
+        that.all_things.push(thing);
+    };
+
+    that.parse_arc = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        var thing = {};
+
+        thing.type = elements[0];
+        thing.colour = elements[1];
+        thing.fill = elements[2] === "f";
+        thing.x = parseFloat(elements[3]);
+        thing.y = parseFloat(elements[4]);
+        thing.radius = parseFloat(elements[5]);
+        thing.start_angle = parseFloat(elements[6]);
+        thing.end_angle = parseFloat(elements[7]);
+        thing.speedx = parseFloat(elements[8]);
+        thing.speedy = parseFloat(elements[9]);
+
+        that.all_things.push(thing);
+    };
+
+    that.parse_poly = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        var thing = {};
+        var n;
+
+        thing.type = elements[0];
+        thing.colour = elements[1];
+        thing.mode = elements[2];       // "f" filled, "c" closed outline, "o" open polyline
+        thing.fill = thing.mode === "f";
+        thing.speedx = parseFloat(elements[3]);
+        thing.speedy = parseFloat(elements[4]);
+        thing.points = [];
+
+        for (n = 5; n < elements.length; n += 1) {
+            thing.points.push(parseFloat(elements[n]));
+        }
+
+        that.all_things.push(thing);
+    };
+
+    that.parse_sprite_ex = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        var thing = {};
+
+        thing.type = elements[0];
+        thing.varname = elements[1];
+        thing.x = parseFloat(elements[2]);
+        thing.y = parseFloat(elements[3]);
+        thing.speedx = parseFloat(elements[4]);
+        thing.speedy = parseFloat(elements[5]);
+        thing.angle = parseFloat(elements[6]);
+        thing.spin = parseFloat(elements[7]);
+        thing.scalex = parseFloat(elements[8]);      // Negative if flipped
+        thing.scaley = parseFloat(elements[9]);
+        thing.alpha = parseFloat(elements[10]);
+
+        that.all_things.push(thing);
+    };
+
+    that.parse_frame = function (blob) {
+
+        var elements = blob.split(String.fromCharCode(31));
+
+        var thing = {};
+
+        thing.type = elements[0];
+        thing.varname = elements[1];
+        thing.first = parseInt(elements[2], 10);
+        thing.last = parseInt(elements[3], 10);
+        thing.rate = parseFloat(elements[4]);       // Frames per second
+        thing.x = parseFloat(elements[5]);
+        thing.y = parseFloat(elements[6]);
+        thing.speedx = parseFloat(elements[7]);
+        thing.speedy = parseFloat(elements[8]);
+
+        that.all_things.push(thing);
+    };
+
+    // How far a thing has moved since its frame, from its speed and any acceleration.
+
+    that.drift_x = function (thing, time_offset) {
+        var t = time_offset / 1000;
+        return thing.speedx * t + thing.state.accel_x * t * t / 2;
+    };
+
+    that.drift_y = function (thing, time_offset) {
+        var t = time_offset / 1000;
+        return thing.speedy * t + thing.state.accel_y * t * t / 2;
+    };
+
+    // Things with spin in their state are turned about their centre. Those with no centre here
+    // don't spin.
+
+    that.centre = function (thing) {
+
+        var n;
+        var sx = 0;
+        var sy = 0;
+
+        switch (thing.type) {
+        case "r":
+            return [thing.x + thing.width / 2, thing.y + thing.height / 2];
+        case "l":
+            return [(thing.x1 + thing.x2) / 2, (thing.y1 + thing.y2) / 2];
+        case "g":
+            for (n = 0; n + 1 < thing.points.length; n += 2) {
+                sx += thing.points[n];
+                sy += thing.points[n + 1];
+            }
+            return [sx * 2 / thing.points.length, sy * 2 / thing.points.length];
+        case "P":
+        case "m":
+            return null;
+        default:
+            return [thing.x, thing.y];
+        }
+    };
+
+    // Things in groups are drawn in the group's coordinates, outermost group first. In
+    // interpolation mode, groups with ids are blended like things; others move at their speeds.
+
+    that.apply_group = function (group, time_offset) {
+
+        var other;
+
+        if (group.parent !== null) {
+            that.apply_group(group.parent, time_offset);
+        }
+
+        if (that.interp_newer !== null && group.id !== undefined && (other = that.interp_newer.groups_by_id[group.id]) !== undefined) {
+            group = that.blend(group, other, that.interp_t);
+        }
+
+        virtue.translate(group.x + group.speedx * time_offset / 1000, group.y + group.speedy * time_offset / 1000);
+        virtue.rotate(group.angle);
+        virtue.scale(group.scale, group.scale);
+    };
+
+    that.draw_thing = function (thing, time_offset, group_offset) {
+
+        // group_offset is for the thing's groups, if different from the thing's own offset,
+        // as when the thing has been blended but its groups haven't.
+
+        var spin = thing.state.spin;
+        var group = thing.state.group;
+        var centre = null;
+
+        if (spin !== 0 && time_offset !== 0) {
+            centre = that.centre(thing);
+        }
+
+        if (centre === null && group === null) {
+            that.drawers[thing.type](thing, time_offset);
+            return;
+        }
+
+        virtue.save();
+
+        if (group !== null) {
+            that.apply_group(group, group_offset === undefined ? time_offset : group_offset);
+        }
+
+        if (centre !== null) {
+            var x = centre[0] + that.drift_x(thing, time_offset);
+            var y = centre[1] + that.drift_y(thing, time_offset);
+            virtue.translate(x, y);
+            virtue.rotate(spin * time_offset / 1000);
+            virtue.translate(-x, -y);
+        }
+
+        that.drawers[thing.type](thing, time_offset);
+        virtue.restore();
+    };
+
+    that.draw_text = function(t, time_offset) {
+        var st = t.state;
+        var x = Math.floor(t.x + that.drift_x(t, time_offset));
+        var y = Math.floor(t.y + that.drift_y(t, time_offset));
+
+        virtue.font = t.size.toString() + "px " + t.font;
+        virtue.textAlign = st.text_align;
+
+        var lines = that.text_lines(t.text, st.max_width);
+        var line_height = t.size * st.line_height;
+        var block_height = line_height * (lines.length - 1);
+
+        // With no baseline set, we keep the old behaviour of offsetting by half the size.
+        // Otherwise, the baseline also says where the block of lines sits relative to y.
+
+        if (st.text_baseline === "") {
+            virtue.textBaseline = "alphabetic";
+            y += Math.floor(t.size / 2);
+        } else {
+            virtue.textBaseline = st.text_baseline;
+            if (st.text_baseline === "middle") {
+                y -= block_height / 2;
+            } else if (st.text_baseline === "bottom" || st.text_baseline === "alphabetic") {
+                y -= block_height;
+            }
+        }
+
+        var n;
+
+        if (st.outline_colour !== "" && st.outline_width > 0) {
+            virtue.strokeStyle = that.style(st.outline_colour, x, y);
+            virtue.lineWidth = st.outline_width * 2;        // Half of it is hidden under the fill
+            virtue.lineJoin = "round";
+            virtue.setLineDash([]);
+            for (n = 0; n < lines.length; n += 1) {
+                virtue.strokeText(lines[n], x, y + n * line_height);
+            }
+        }
+
+        virtue.fillStyle = that.style(t.colour, x, y);
+        for (n = 0; n < lines.length; n += 1) {
+            virtue.fillText(lines[n], x, y + n * line_height);
+        }
+    };
+
+    that.text_lines = function (text, max_width) {
+
+        // Split on newlines, then wrap by words if a max width is set. Needs the font set already.
+
+        var paragraphs = text.split("\n");
+
+        if (max_width <= 0) {
+            return paragraphs;
+        }
+
+        var lines = [];
+        var n;
+        var i;
+
+        for (n = 0; n < paragraphs.length; n += 1) {
+            var words = paragraphs[n].split(" ");
+            var line = words[0];
+            for (i = 1; i < words.length; i += 1) {
+                if (virtue.measureText(line + " " + words[i]).width > max_width) {
+                    lines.push(line);
+                    line = words[i];
+                } else {
+                    line += " " + words[i];
+                }
+            }
+            lines.push(line);
+        }
+
+        return lines;
+    };
+
+    that.draw_point = function (p, time_offset) {
+        var x = p.x + that.drift_x(p, time_offset);
+        var y = p.y + that.drift_y(p, time_offset);
+        virtue.fillStyle = that.style(p.colour, x, y);
+        if (p.state.point_round) {
+            virtue.beginPath();
+            virtue.arc(x, y, p.state.point_size / 2, 0, 2 * Math.PI);
+            virtue.fill();
+        } else if (p.state.point_size === 1) {
+            virtue.fillRect(Math.floor(x), Math.floor(y), 1, 1);
+        } else {
+            virtue.fillRect(x - p.state.point_size / 2, y - p.state.point_size / 2, p.state.point_size, p.state.point_size);
+        }
+    };
+
+    that.draw_points = function (p, time_offset) {
+
+        // Round points all go into one path, which is filled once.
+
+        var values = p.values;
+        var size = p.state.point_size;
+        var half = size / 2;
+        var t = time_offset / 1000;
+        var ax = p.state.accel_x * t * t / 2;
+        var ay = p.state.accel_y * t * t / 2;
+        var x;
+        var y;
+        var n;
+
+        virtue.fillStyle = that.style(p.colour, 0, 0);
+
+        if (p.state.point_round) {
+            virtue.beginPath();
+            for (n = 0; n + 3 < values.length; n += 4) {
+                x = values[n] + values[n + 2] * t + ax;
+                y = values[n + 1] + values[n + 3] * t + ay;
+                virtue.moveTo(x + half, y);
+                virtue.arc(x, y, half, 0, 2 * Math.PI);
+            }
+            virtue.fill();
+        } else {
+            for (n = 0; n + 3 < values.length; n += 4) {
+                x = values[n] + values[n + 2] * t + ax;
+                y = values[n + 1] + values[n + 3] * t + ay;
+                if (size === 1) {
+                    virtue.fillRect(Math.floor(x), Math.floor(y), 1, 1);
+                } else {
+                    virtue.fillRect(x - half, y - half, size, size);
+                }
+            }
+        }
+    };
+
+    that.draw_sprite = function (sp, time_offset) {
+        var x = sp.x + that.drift_x(sp, time_offset);
+        var y = sp.y + that.drift_y(sp, time_offset);
+        virtue.drawImage(window[sp.varname], x - window[sp.varname].width / 2, y - window[sp.varname].height / 2);
+    };
+
+    that.draw_sprite_ex = function (sp, time_offset) {
+        var x = sp.x + that.drift_x(sp, time_offset);
+        var y = sp.y + that.drift_y(sp, time_offset);
+        var angle = sp.angle + sp.spin * time_offset / 1000;
+        var img = window[sp.varname];
+
+        if (!img) {
+            return;
+        }
+
+        virtue.save();
+        virtue.globalAlpha *= sp.alpha;     // Effects may already have faded it
+        virtue.translate(x, y);
+        virtue.rotate(angle);
+        virtue.scale(sp.scalex, sp.scaley);
+        virtue.drawImage(img, -img.width / 2, -img.height / 2);
+        virtue.restore();
+    };
+
+    that.draw_frame = function (sp, time_offset) {
+
+        // The animation runs off the client's clock rather than the time since the last frame,
+        // so it doesn't restart every time a new frame arrives.
+
+        var img = window[sp.varname];
+
+        if (!img || !img.frame_w || !img.complete || img.width < img.frame_w) {
+            return;
+        }
+
+        var x = sp.x + that.drift_x(sp, time_offset);
+        var y = sp.y + that.drift_y(sp, time_offset);
+
+        var count = sp.last - sp.first + 1;
+        var frame = sp.first;
+        if (count > 1 && sp.rate > 0) {
+            frame += Math.floor(Date.now() * sp.rate / 1000) % count;
+        }
+
+        var cols = Math.floor(img.width / img.frame_w);
+        var sx = (frame % cols) * img.frame_w;
+        var sy = Math.floor(frame / cols) * img.frame_h;
+
+        virtue.drawImage(img, sx, sy, img.frame_w, img.frame_h, x - img.frame_w / 2, y - img.frame_h / 2, img.frame_w, img.frame_h);
+    };
+
+    that.draw_tilemap = function (m, time_offset) {
+
+        var map = that.tilemaps[m.map_id];
+
+        if (!map) {
+            return;
+        }
+
+        var img = window[map.varname];
+
+        if (!img || !img.frame_w || !img.complete || img.width < img.frame_w) {
+            return;
+        }
+
+        var tw = img.frame_w;
+        var th = img.frame_h;
+        var sheet_cols = Math.floor(img.width / tw);
+
+        // Work out which part of the map is on screen, by taking the screen corners back through
+        // the current transform (i.e. the camera, if any).
+
+        var inv = virtue.getTransform().inverse();
+        var corners = [[0, 0], [WIDTH, 0], [0, HEIGHT], [WIDTH, HEIGHT]];
+        var left = Infinity, top = Infinity, right = -Infinity, bottom = -Infinity;
+        var n;
+
+        for (n = 0; n < 4; n += 1) {
+            var cx = inv.a * corners[n][0] + inv.c * corners[n][1] + inv.e;
+            var cy = inv.b * corners[n][0] + inv.d * corners[n][1] + inv.f;
+            left = Math.min(left, cx);
+            right = Math.max(right, cx);
+            top = Math.min(top, cy);
+            bottom = Math.max(bottom, cy);
+        }
+
+        var col0 = Math.max(0, Math.floor((left - m.x) / tw));
+        var col1 = Math.min(map.cols - 1, Math.floor((right - m.x) / tw));
+        var row0 = Math.max(0, Math.floor((top - m.y) / th));
+        var row1 = Math.min(map.rows - 1, Math.floor((bottom - m.y) / th));
+
+        var row;
+        var col;
+        var tile;
+
+        for (row = row0; row <= row1; row += 1) {
+            for (col = col0; col <= col1; col += 1) {
+                tile = map.tiles[row * map.cols + col];
+                if (tile >= 0) {
+                    virtue.drawImage(img, (tile % sheet_cols) * tw, Math.floor(tile / sheet_cols) * th, tw, th,
+                        m.x + col * tw, m.y + row * th, tw, th);
+                }
+            }
+        }
+    };
+
+    that.draw_line = function (li, time_offset) {
+        var dx = that.drift_x(li, time_offset);
+        var dy = that.drift_y(li, time_offset);
+        var x1 = li.x1 + dx;
+        var y1 = li.y1 + dy;
+        var x2 = li.x2 + dx;
+        var y2 = li.y2 + dy;
+
+        virtue.strokeStyle = that.style(li.colour, x1, y1);
+        that.apply_line_style(li.state);
+        virtue.beginPath();
+        virtue.moveTo(x1, y1);
+        virtue.lineTo(x2, y2);
+        virtue.stroke();
+    };
+
+    that.draw_circle = function (c, time_offset) {
+        var x = c.x + that.drift_x(c, time_offset);
+        var y = c.y + that.drift_y(c, time_offset);
+
+        virtue.beginPath();
+        virtue.arc(x, y, Math.abs(c.radius), 0, 2 * Math.PI);      // arc() throws on a negative radius
+        that.fill_or_stroke(c, x, y);
+    };
+
+    that.draw_rect = function (r, time_offset) {
+        var x = r.x + that.drift_x(r, time_offset);
+        var y = r.y + that.drift_y(r, time_offset);
+
+        virtue.beginPath();
+        if (r.radius > 0) {
+
+            // arcTo() throws on a negative radius, so a rect with negative width or height is
+            // turned the right way round first.
+
+            var rx = Math.min(x, x + r.width);
+            var ry = Math.min(y, y + r.height);
+            var w = Math.abs(r.width);
+            var h = Math.abs(r.height);
+            var rad = Math.min(r.radius, w / 2, h / 2);
+
+            virtue.moveTo(rx + rad, ry);
+            virtue.arcTo(rx + w, ry, rx + w, ry + h, rad);
+            virtue.arcTo(rx + w, ry + h, rx, ry + h, rad);
+            virtue.arcTo(rx, ry + h, rx, ry, rad);
+            virtue.arcTo(rx, ry, rx + w, ry, rad);
+            virtue.closePath();
+        } else {
+            virtue.rect(x, y, r.width, r.height);
+        }
+        that.fill_or_stroke(r, x, y);
+    };
+
+    that.draw_arc = function (a, time_offset) {
+        var x = a.x + that.drift_x(a, time_offset);
+        var y = a.y + that.drift_y(a, time_offset);
+
+        virtue.beginPath();
+        if (a.fill) {
+            virtue.moveTo(x, y);
+        }
+        virtue.arc(x, y, Math.abs(a.radius), a.start_angle, a.end_angle);
+        if (a.fill) {
+            virtue.closePath();
+        }
+        that.fill_or_stroke(a, x, y);
+    };
+
+    that.draw_poly = function (g, time_offset) {
+        var dx = that.drift_x(g, time_offset);
+        var dy = that.drift_y(g, time_offset);
+        var points = g.points;
+        var n;
+
+        virtue.beginPath();
+        virtue.moveTo(points[0] + dx, points[1] + dy);
+        for (n = 2; n + 1 < points.length; n += 2) {
+            virtue.lineTo(points[n] + dx, points[n + 1] + dy);
+        }
+        if (g.mode !== "o") {
+            virtue.closePath();
+        }
+        that.fill_or_stroke(g, points[0] + dx, points[1] + dy);
+    };
+
+    that.fill_or_stroke = function (thing, x, y) {     // x, y is where gradients and patterns are relative to
+        if (thing.fill) {
+            virtue.fillStyle = that.style(thing.colour, x, y);
+            virtue.fill();
+        } else {
+            virtue.strokeStyle = that.style(thing.colour, x, y);
+            that.apply_line_style(thing.state);
+            virtue.stroke();
+        }
+    };
+
+    // Colours starting with ~ describe gradients and patterns. We parse each description once,
+    // but have to make the gradient each time since it's relative to the thing's position.
+
+    that.fill_cache = {};
+    that.fill_cache_size = 0;
+
+    that.style = function (colour, x, y) {
+
+        if (colour.charAt(0) !== "~") {
+            return colour;
+        }
+
+        var desc = that.fill_cache[colour];
+
+        if (desc === undefined) {
+            if (that.fill_cache_size > 1000) {
+                that.fill_cache = {};
+                that.fill_cache_size = 0;
+            }
+            desc = that.parse_fill(colour);
+            that.fill_cache[colour] = desc;
+            that.fill_cache_size += 1;
+        }
+
+        var grad;
+        var n;
+
+        // The constructors throw on negative radii and non-finite numbers. Nothing would catch
+        // that, and the page would stop drawing, so a bad fill is just transparent.
+
+        try {
+            switch (desc.kind) {
+            case "l":
+                grad = virtue.createLinearGradient(x + desc.nums[0], y + desc.nums[1], x + desc.nums[2], y + desc.nums[3]);
+                break;
+            case "r":
+                grad = virtue.createRadialGradient(x + desc.nums[0], y + desc.nums[1], desc.nums[2], x + desc.nums[3], y + desc.nums[4], desc.nums[5]);
+                break;
+            case "p":
+                var img = window[desc.varname];
+                if (!img || !img.complete || img.width === 0) {
+                    return "rgba(0,0,0,0)";
+                }
+                if (!desc.pattern) {
+                    desc.pattern = virtue.createPattern(img, desc.repeat);
+                }
+                if (desc.pattern.setTransform && window.DOMMatrix) {
+                    desc.pattern.setTransform(new DOMMatrix().translateSelf(x, y));
+                }
+                return desc.pattern;
+            default:
+                return "rgba(0,0,0,0)";
+            }
+        } catch (e) {
+            return "rgba(0,0,0,0)";
+        }
+
+        for (n = 0; n < desc.stops.length; n += 1) {
+            try {
+                grad.addColorStop(desc.stops[n].offset, desc.stops[n].colour);
+            } catch (e) {
+                // Bad offset or colour; ignore the stop
+            }
+        }
+
+        return grad;
+    };
+
+    that.parse_fill = function (colour) {
+
+        // ~l|x0|y0|x1|y1|stops...   ~r|x0|y0|r0|x1|y1|r1|stops...   ~p|varname|repeat
+        // where stops are offset|colour pairs.
+
+        var parts = colour.split("|");
+        var desc = {kind: parts[0].charAt(1), nums: [], stops: []};
+        var count = 0;
+        var n;
+
+        if (desc.kind === "p") {
+            desc.varname = parts[1];
+            desc.repeat = parts[2];
+            return desc;
+        }
+
+        if (desc.kind === "l") {
+            count = 4;
+        } else if (desc.kind === "r") {
+            count = 6;
+        }
+
+        for (n = 1; n <= count; n += 1) {
+            desc.nums.push(parseFloat(parts[n]));
+        }
+
+        for (n = count + 1; n + 1 < parts.length; n += 2) {
+            desc.stops.push({offset: parseFloat(parts[n]), colour: parts[n + 1]});
+        }
+
+        return desc;
+    };
+
+    that.apply_shadow = function (state) {
+        if (state.shadow_colour !== "") {
+            virtue.shadowColor = state.shadow_colour;
+            virtue.shadowBlur = state.shadow_blur;
+            virtue.shadowOffsetX = state.shadow_x;
+            virtue.shadowOffsetY = state.shadow_y;
+        } else {
+            virtue.shadowColor = "rgba(0,0,0,0)";
+            virtue.shadowBlur = 0;
+            virtue.shadowOffsetX = 0;
+            virtue.shadowOffsetY = 0;
+        }
+    };
+
+    that.apply_line_style = function (state) {
+        virtue.lineWidth = state.line_width;
+        virtue.setLineDash(state.dash);
+        virtue.lineCap = state.cap;
+        virtue.lineJoin = state.join;
+    };
+
+    that.draw = function () {
+
+        virtue.clearRect(0, 0, WIDTH, HEIGHT);     // The best way to clear the canvas??
+        that.draw_background();
+
+        // As a relatively simple way of dealing with arbitrary timings of incoming data, we
+        // always try to draw the object "where it is now" taking into account how long it's
+        // been since we received info about it. This is done with this "time_offset" var.
+
+        var time_offset = Date.now() - that.last_frame_time;
+
+        // In interpolation mode, we draw the older of two frames, blending things towards the
+        // newer one, and time_offset becomes the time since the older one...
+
+        var now = Date.now();
+        var older = null;
+        var newer = null;
+        var blend_t = 0;
+
+        that.interp_newer = null;
+
+        if (that.interp_delay > 0 && that.snapshots.length > 0) {
+
+            var render_time = now - that.interp_delay;
+            var pair = that.choose_snapshots(render_time);
+
+            older = pair[0];
+            newer = pair[1];
+
+            if (older !== that.drawn_snapshot) {
+                that.frame_things = older.things;
+                that.rebuild_draw_list();
+                that.drawn_snapshot = older;
+            }
+
+            time_offset = Math.max(0, render_time - older.time);
+            that.camera = older.camera;
+
+            if (newer !== null) {
+                blend_t = Math.min(1, time_offset / (newer.time - older.time));
+                that.interp_newer = newer;
+                that.interp_t = blend_t;
+                if (older.camera !== null && newer.camera !== null) {
+                    that.camera = that.blend(older.camera, newer.camera, blend_t);
+                }
+            }
+        }
+
+        // Cache various things for speed reasons...
+
+        var all_things = that.draw_list;
+        var len = all_things.length;
+        var draw_thing = that.draw_thing;
+        var other;
+
+        // Things below LAYER_HUD are seen through the camera, if there is one. Since things are
+        // sorted by layer, we switch transform at most twice.
+
+        var camera = that.camera;
+        var in_world = false;
+        var want_world;
+        var thing;
+        var last_state = null;
+
+        var n;
+        for (n = 0; n < len; n += 1) {
+
+            thing = all_things[n];
+            want_world = camera !== null && thing.state.layer < LAYER_HUD;
+
+            if (thing.state !== last_state) {
+                that.apply_shadow(thing.state);
+                last_state = thing.state;
+            }
+
+            if (want_world !== in_world) {
+                that.set_transform(want_world, time_offset);
+                in_world = want_world;
+            }
+
+            if (thing.received !== undefined) {
+                draw_thing(thing, now - thing.received);
+            } else if (newer !== null && thing.id !== undefined && (other = newer.by_id[thing.id]) !== undefined && other.type === thing.type) {
+                draw_thing(that.blend(thing, other, blend_t), 0, time_offset);
+            } else {
+                draw_thing(thing, time_offset);
+            }
+        }
+
+        that.interp_newer = null;           // Effects aren't in the snapshots
+        that.draw_effects(in_world);
+
+        virtue.setTransform(1, 0, 0, 1, 0, 0);
+        that.apply_shadow(that.default_state());
+    };
+
+    that.background = "";
+    that.background_image = "";
+    that.background_mode = "stretch";
+
+    that.set_page = function (stuff) {
+        that.background = stuff[1];
+        that.background_image = stuff[2];
+        that.background_mode = stuff[3];
+        that.background_pattern = null;
+        document.body.style.backgroundColor = stuff[4];
+        canvas.style.borderStyle = stuff[5] === "1" ? "dashed" : "none";
+        document.getElementById("stats").style.display = stuff[6] === "1" ? "inline" : "none";
+    };
+
+    that.draw_background = function () {
+
+        if (that.background !== "") {
+            virtue.fillStyle = that.style(that.background, 0, 0);       // Could be a gradient or pattern
+            virtue.fillRect(0, 0, WIDTH, HEIGHT);
+        }
+
+        var img = window[that.background_image];
+
+        if (!img || !img.complete || img.width === 0) {
+            return;
+        }
+
+        if (that.background_mode === "tile") {
+            if (!that.background_pattern) {
+                that.background_pattern = virtue.createPattern(img, "repeat");
+            }
+            virtue.fillStyle = that.background_pattern;
+            virtue.fillRect(0, 0, WIDTH, HEIGHT);
+        } else if (that.background_mode === "centre") {
+            virtue.drawImage(img, (WIDTH - img.width) / 2, (HEIGHT - img.height) / 2);
+        } else {
+            virtue.drawImage(img, 0, 0, WIDTH, HEIGHT);
+        }
+    };
+
+    that.set_transform = function (world, time_offset) {
+        var camera = that.camera;
+        if (world) {
+            virtue.setTransform(1, 0, 0, 1, WIDTH / 2, HEIGHT / 2);
+            virtue.scale(camera.zoom, camera.zoom);
+            virtue.rotate(-camera.angle);
+            virtue.translate(-(camera.x + camera.speedx * time_offset / 1000), -(camera.y + camera.speedy * time_offset / 1000));
+        } else {
+            virtue.setTransform(1, 0, 0, 1, 0, 0);
+        }
+    };
+
+    // Effects are things that outlive the frame they arrived in, fading out over their lifetime.
+    // They move from where they were created, and are drawn on top of everything else.
+
+    that.draw_effects = function (in_world) {
+
+        var now = Date.now();
+        var time_offset = now - that.last_frame_time;
+        var camera = that.camera;
+        var draw_thing = that.draw_thing;
+        var want_world;
+        var age;
+        var e;
+
+        that.effects = that.effects.filter(function (e) {
+            return now - e.born < e.life;
+        });
+
+        var n;
+        for (n = 0; n < that.effects.length; n += 1) {
+
+            e = that.effects[n];
+
+            if (that.hidden_layers[e.state.layer]) {
+                continue;
+            }
+
+            want_world = camera !== null && e.state.layer < LAYER_HUD;
+
+            if (want_world !== in_world) {
+                that.set_transform(want_world, time_offset);
+                in_world = want_world;
+            }
+
+            that.apply_shadow(e.state);
+            age = now - e.born;
+            virtue.globalAlpha = 1 - age / e.life;
+            draw_thing(e, age);
+        }
+
+        virtue.globalAlpha = 1;
+    };
+
+    that.animate = function () {
+
+        if (that.ws_frames > 0) {
+            that.total_draws += 1;
+        }
+
+        if (that.total_draws % 10 === 0) {
+            document.getElementById("ws_frames").innerHTML = that.ws_frames;
+            document.getElementById("total_draws").innerHTML = that.total_draws;
+        }
+
+        that.poll_gamepads();
+        that.send_mouse_delta();
+        that.draw();
+        requestAnimationFrame(that.animate);
+    };
+
+    that.display_debug_message = function (s) {
+        document.getElementById("debug_msg").innerHTML = "--- " + s;
+    };
+
+    // Sound from Thomas Sturm: http://www.storiesinflight.com/html5/audio.html
+
+    that.init_sound = function () {
+        that.audiochannels = [];
+        while (that.audiochannels.length < channel_max) {
+            that.audiochannels.push({channel: new Audio(), finished: -1});
+        }
+    };
+
+    that.play_multi_sound = function (s) {
+        var a;
+        var thistime;
+
+        for (a = 0; a < that.audiochannels.length; a += 1) {
+            thistime = new Date();
+            if (that.audiochannels[a].finished < thistime.getTime()) {
+                that.audiochannels[a].finished = thistime.getTime() + document.getElementById(s).duration * 1000;
+                that.audiochannels[a].channel.src = document.getElementById(s).src;
+                that.audiochannels[a].channel.load();
+                that.audiochannels[a].channel.play();
+                break;
+            }
+        }
+    };
+
+    // Thing type -> parse function, for blobs that make a thing to draw...
+
+    that.parsers = {
+        l: that.parse_line,
+        p: that.parse_point_or_sprite,
+        s: that.parse_point_or_sprite,
+        t: that.parse_text,
+        c: that.parse_circle,
+        r: that.parse_rect,
+        a: that.parse_arc,
+        g: that.parse_poly,
+        S: that.parse_sprite_ex,
+        f: that.parse_frame,
+        P: that.parse_points,
+        m: that.parse_tilemap
+    };
+
+    // Thing type -> draw function. Must match the parse functions...
+
+    that.drawers = {
+        l: that.draw_line,
+        p: that.draw_point,
+        s: that.draw_sprite,
+        t: that.draw_text,
+        c: that.draw_circle,
+        r: that.draw_rect,
+        a: that.draw_arc,
+        g: that.draw_poly,
+        S: that.draw_sprite_ex,
+        f: that.draw_frame,
+        P: that.draw_points,
+        m: that.draw_tilemap
+    };
+
     that.init_sound();
     return that;
 }
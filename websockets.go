@@ -4,9 +4,11 @@ import (
     "fmt"
     "io/ioutil"
     "net/http"
+    "net/url"
     "strconv"
     "strings"
     "sync"
+    "time"
 
     "github.com/gorilla/websocket"
 )
@@ -47,9 +49,18 @@ func ws_handler(writer http.ResponseWriter, request * http.Request) {
     }
 
     keyboard := make(map[string]bool)
-    eng.players[pid] = &player{pid, keyboard, nil, conn}
+    codes := make(map[string]string)
+    held := make(map[string]string)
+    gamepads := make(map[int]*gamepad)
+    eng.players[pid] = &player{pid: pid, keyboard: keyboard, codes: codes, held: held, gamepads: gamepads, conn: conn}
     eng.latest_player = pid
 
+    if eng.pointer_lock {
+        conn.WriteMessage(websocket.TextMessage, pointer_lock_message())
+    }
+
+    conn.WriteMessage(websocket.TextMessage, page_settings_message())
+
     eng.mutex.Unlock()
 
     // Handle incoming messages until connection fails...
@@ -63,7 +74,7 @@ func ws_handler(writer http.ResponseWriter, request * http.Request) {
             fmt.Printf("Connection CLOSED: %s (%v)\n", request.RemoteAddr, err)
 
             eng.mutex.Lock()
-            delete(eng.players, pid)
+            delete(eng.players, pid)            // Which also forgets any keys it was holding
             eng.mutex.Unlock()
 
             return
@@ -73,14 +84,33 @@ func ws_handler(writer http.ResponseWriter, request * http.Request) {
 
         fields := strings.Fields(string(bytes))
 
+        if len(fields) == 0 {
+            continue
+        }
+
+        // Every input message from the client ends with the client's timestamp, after the fixed
+        // fields for that message type. Each case below knows where to find it.
+
+        ev := event{Type: fields[0], ServerTime: time.Now()}
+
         switch fields[0] {
 
         case "keyup":
 
             if len(fields) > 1 {
+
+                ev.parse_key_fields(fields)
+
                 eng.mutex.Lock()
                 if eng.players[pid] != nil {
-                    eng.players[pid].keyboard[fields[1]] = false
+                    p := eng.players[pid]
+                    p.keyboard[ev.Key] = false
+                    if key, ok := p.held[ev.Code]; ok {        // e.g. Shift released before A: the key that went down was "A", not "a"
+                        p.keyboard[key] = false
+                        delete(p.held, ev.Code)
+                    }
+                    delete(p.codes, ev.Code)
+                    p.add_event(ev)
                 }
                 eng.mutex.Unlock()
             }
@@ -88,9 +118,18 @@ func ws_handler(writer http.ResponseWriter, request * http.Request) {
         case "keydown":
 
             if len(fields) > 1 {
+
+                ev.parse_key_fields(fields)
+
                 eng.mutex.Lock()
-                if eng.players[pid] != nil {
-                    eng.players[pid].keyboard[fields[1]] = true
+                if eng.players[pid] != nil && (ev.Repeat == false || eng.drop_key_repeats == false) {
+                    p := eng.players[pid]
+                    p.keyboard[ev.Key] = true
+                    if ev.Code != "" {
+                        p.codes[ev.Code] = ev.Key
+                        p.held[ev.Code] = ev.Key
+                    }
+                    p.add_event(ev)
                 }
                 eng.mutex.Unlock()
             }
@@ -103,12 +142,182 @@ func ws_handler(writer http.ResponseWriter, request * http.Request) {
                 x, _ := strconv.Atoi(fields[2])
                 y, _ := strconv.Atoi(fields[3])
 
+                ev.Button, ev.X, ev.Y = button, x, y
+                ev.ClientTime = client_time(fields, 4)
+
                 eng.mutex.Lock()
                 if eng.players[pid] != nil {
                     eng.players[pid].clicks = append(eng.players[pid].clicks, click{Button: button, X: x, Y: y})
+                    eng.players[pid].add_event(ev)
+                }
+                eng.mutex.Unlock()
+            }
+
+        case "padbutton":
+
+            if len(fields) > 3 {
+
+                pad, _ := strconv.Atoi(fields[1])
+                button, _ := strconv.Atoi(fields[2])
+                down := fields[3] == "1"
+
+                ev.Pad, ev.Button = pad, button
+                if down {
+                    ev.Value = 1
+                }
+                ev.ClientTime = client_time(fields, 4)
+
+                eng.mutex.Lock()
+                if eng.players[pid] != nil {
+                    eng.players[pid].get_gamepad(pad).buttons[button] = down
+                    eng.players[pid].add_event(ev)
+                }
+                eng.mutex.Unlock()
+            }
+
+        case "padaxis":
+
+            if len(fields) > 3 {
+
+                pad, _ := strconv.Atoi(fields[1])
+                axis, _ := strconv.Atoi(fields[2])
+                value, _ := strconv.ParseFloat(fields[3], 64)
+
+                ev.Pad, ev.Axis, ev.Value = pad, axis, value
+                ev.ClientTime = client_time(fields, 4)
+
+                eng.mutex.Lock()
+                if eng.players[pid] != nil {
+                    eng.players[pid].get_gamepad(pad).axes[axis] = value
+                    eng.players[pid].add_event(ev)
                 }
                 eng.mutex.Unlock()
             }
+
+        case "padgone":
+
+            if len(fields) > 1 {
+
+                pad, _ := strconv.Atoi(fields[1])
+
+                ev.Pad = pad
+                ev.ClientTime = client_time(fields, 2)
+
+                eng.mutex.Lock()
+                if eng.players[pid] != nil {
+                    delete(eng.players[pid].gamepads, pad)
+                    eng.players[pid].add_event(ev)
+                }
+                eng.mutex.Unlock()
+            }
+
+        case "focus":
+
+            if len(fields) > 1 {
+
+                ev.Focused = fields[1] == "1"
+                ev.ClientTime = client_time(fields, 2)
+
+                eng.mutex.Lock()
+                if eng.players[pid] != nil {
+                    if ev.Focused == false {
+                        eng.players[pid].release_all_keys(ev)
+                    }
+                    eng.players[pid].add_event(ev)
+                }
+                eng.mutex.Unlock()
+            }
+
+        case "text":
+
+            // text =<URI-encoded string> <timestamp> -- encoded since it can contain spaces, and
+            // with the = so that an empty string still makes a field
+
+            if len(fields) > 1 && strings.HasPrefix(fields[1], "=") {
+
+                text, _ := url.PathUnescape(fields[1][1:])
+
+                ev.ClientTime = client_time(fields, 2)
+
+                eng.mutex.Lock()
+                if eng.players[pid] != nil {
+                    ev.Text = truncate_runes(text, eng.players[pid].text_maxlen)
+                    eng.players[pid].add_event(ev)
+                }
+                eng.mutex.Unlock()
+            }
+
+        case "mousedelta":
+
+            if len(fields) > 2 {
+
+                dx, _ := strconv.ParseFloat(fields[1], 64)
+                dy, _ := strconv.ParseFloat(fields[2], 64)
+
+                eng.mutex.Lock()
+                if eng.players[pid] != nil {
+                    eng.players[pid].mouse_dx += dx
+                    eng.players[pid].mouse_dy += dy
+                }
+                eng.mutex.Unlock()
+            }
+
+        case "pointerlock":
+
+            if len(fields) > 1 {
+
+                ev.Locked = fields[1] == "1"
+                ev.ClientTime = client_time(fields, 2)
+
+                eng.mutex.Lock()
+                if eng.players[pid] != nil {
+                    eng.players[pid].add_event(ev)
+                }
+                eng.mutex.Unlock()
+            }
+
+        case "textcancel":
+
+            ev.ClientTime = client_time(fields, 1)
+
+            eng.mutex.Lock()
+            if eng.players[pid] != nil {
+                eng.players[pid].add_event(ev)
+            }
+            eng.mutex.Unlock()
         }
     }
 }
+
+func (ev *event) parse_key_fields(fields []string) {
+
+    // keydown / keyup <key> <code> <modifier bits> <repeat> <timestamp>
+
+    ev.Key = fields[1]
+
+    if len(fields) > 2 {
+        ev.Code = fields[2]
+    }
+
+    if len(fields) > 3 {
+        mods, _ := strconv.Atoi(fields[3])
+        ev.Shift = mods & 1 != 0
+        ev.Ctrl = mods & 2 != 0
+        ev.Alt = mods & 4 != 0
+        ev.Meta = mods & 8 != 0
+    }
+
+    if len(fields) > 4 {
+        ev.Repeat = fields[4] == "1"
+    }
+
+    ev.ClientTime = client_time(fields, 5)
+}
+
+func client_time(fields []string, n int) int64 {
+    if len(fields) > n {
+        t, _ := strconv.ParseInt(fields[n], 10, 64)
+        return t
+    }
+    return 0
+}